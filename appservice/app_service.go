@@ -1,16 +1,110 @@
 package appservice
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 )
 
+type DrainType string
+
+const (
+	DrainTypeLogs    DrainType = "logs"
+	DrainTypeMetrics DrainType = "metrics"
+	DrainTypeAll     DrainType = "all"
+)
+
+var (
+	ErrMissingUrl       = errors.New("app service has no url")
+	ErrInvalidDrainType = errors.New("invalid drain type")
+)
+
+type TLSSettings struct {
+	SkipCertVerify bool   `json:"skip_cert_verify,omitempty"`
+	ServerName     string `json:"server_name,omitempty"`
+	CACert         string `json:"ca_cert,omitempty"`
+}
+
+// AppService is a drain of an app. Everything but AppId and Url is optional;
+// the Id only depends on the Url without its credentials, so that it stays
+// stable when metadata or credentials change.
 type AppService struct {
-	AppId string
-	Url   string
+	AppId     string
+	Url       string
+	Type      DrainType
+	TLS       TLSSettings
+	Filter    string
+	CreatedAt time.Time
 }
 
 func (a AppService) Id() string {
-	hash := sha1.Sum([]byte(a.Url))
+	hash := sha1.Sum([]byte(withoutCredentials(a.Url)))
 	return fmt.Sprintf("%x", hash)
 }
+
+// Equal compares every field, unlike Id which only tells whether two app
+// services are the same drain.
+func (a AppService) Equal(b AppService) bool {
+	return a.AppId == b.AppId && a.Url == b.Url && a.Type == b.Type && a.TLS == b.TLS &&
+		a.Filter == b.Filter && a.CreatedAt.Equal(b.CreatedAt)
+}
+
+// HasMetadata is false for app services that only carry a Url.
+func (a AppService) HasMetadata() bool {
+	return a.Type != "" || a.TLS != (TLSSettings{}) || a.Filter != "" || !a.CreatedAt.IsZero()
+}
+
+type storeValue struct {
+	Url       string      `json:"url"`
+	Type      DrainType   `json:"type,omitempty"`
+	TLS       TLSSettings `json:"tls,omitempty"`
+	Filter    string      `json:"filter,omitempty"`
+	CreatedAt *time.Time  `json:"created_at,omitempty"`
+}
+
+// StoreValue encodes the app service for the store. App services without
+// metadata are stored as their plain Url, like they always were; all others
+// as a JSON object.
+func (a AppService) StoreValue() ([]byte, error) {
+	if !a.HasMetadata() {
+		return []byte(a.Url), nil
+	}
+
+	value := storeValue{Url: a.Url, Type: a.Type, TLS: a.TLS, Filter: a.Filter}
+	if !a.CreatedAt.IsZero() {
+		createdAt := a.CreatedAt.UTC()
+		value.CreatedAt = &createdAt
+	}
+	return json.Marshal(value)
+}
+
+// FromStoreValue decodes a value written by StoreValue. Values that are not
+// JSON objects are taken to be a plain Url.
+func FromStoreValue(appId string, data []byte) (AppService, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return AppService{AppId: appId, Url: string(data)}, nil
+	}
+
+	var value storeValue
+	if err := json.Unmarshal(trimmed, &value); err != nil {
+		return AppService{}, err
+	}
+	if value.Url == "" {
+		return AppService{}, ErrMissingUrl
+	}
+	switch value.Type {
+	case "", DrainTypeLogs, DrainTypeMetrics, DrainTypeAll:
+	default:
+		return AppService{}, ErrInvalidDrainType
+	}
+
+	appService := AppService{AppId: appId, Url: value.Url, Type: value.Type, TLS: value.TLS, Filter: value.Filter}
+	if value.CreatedAt != nil {
+		appService.CreatedAt = value.CreatedAt.UTC()
+	}
+	return appService, nil
+}
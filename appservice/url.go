@@ -0,0 +1,111 @@
+package appservice
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidUrl         = errors.New("invalid drain url")
+	ErrUnsupportedScheme  = errors.New("unsupported drain url scheme")
+	ErrInternalAddress    = errors.New("drain url points to an internal address")
+	DefaultAllowedSchemes = []string{"syslog", "syslog-tls", "https"}
+)
+
+var defaultPorts = map[string]string{
+	"syslog":     "514",
+	"syslog-tls": "6514",
+	"http":       "80",
+	"https":      "443",
+}
+
+// UrlPolicy decides which drain urls are acceptable. The zero value allows
+// the DefaultAllowedSchemes and rejects internal addresses.
+type UrlPolicy struct {
+	AllowedSchemes []string
+	AllowInternal  bool
+}
+
+// NormalizeUrl normalizes a drain url with the default UrlPolicy.
+func NormalizeUrl(rawUrl string) (string, error) {
+	return UrlPolicy{}.Normalize(rawUrl)
+}
+
+// Normalize validates a drain url and returns its canonical form: lowercase
+// scheme and host, an explicit port and no empty path. Hosts that are
+// loopback, private, link-local or unspecified addresses are rejected unless
+// AllowInternal is set; host names are not resolved.
+func (p UrlPolicy) Normalize(rawUrl string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil || u.Opaque != "" || u.Host == "" {
+		return "", ErrInvalidUrl
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	if !p.allows(u.Scheme) {
+		return "", ErrUnsupportedScheme
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		return "", ErrInvalidUrl
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", ErrInvalidUrl
+	}
+	if !p.AllowInternal && isInternalHost(host) {
+		return "", ErrInternalAddress
+	}
+
+	u.Host = net.JoinHostPort(host, port)
+	if u.Path == "/" && u.RawQuery == "" {
+		u.Path = ""
+	}
+	u.RawPath = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+func (p UrlPolicy) allows(scheme string) bool {
+	allowed := p.AllowedSchemes
+	if len(allowed) == 0 {
+		allowed = DefaultAllowedSchemes
+	}
+	for _, s := range allowed {
+		if strings.EqualFold(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+func isInternalHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// withoutCredentials strips the user info from a url so that secrets never end
+// up in ids or logs.
+func withoutCredentials(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.User == nil {
+		return rawUrl
+	}
+	u.User = nil
+	return u.String()
+}
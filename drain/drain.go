@@ -0,0 +1,155 @@
+package drain
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+const (
+	defaultBufferSize   = 100
+	defaultDialTimeout  = 5 * time.Second
+	defaultWriteTimeout = 5 * time.Second
+	defaultMinBackoff   = 100 * time.Millisecond
+	defaultMaxBackoff   = time.Minute
+)
+
+type Config struct {
+	BufferSize     int
+	DialTimeout    time.Duration
+	WriteTimeout   time.Duration
+	MinBackoff     time.Duration
+	MaxBackoff     time.Duration
+	SkipCertVerify bool
+}
+
+func (c Config) withDefaults() Config {
+	if c.BufferSize <= 0 {
+		c.BufferSize = defaultBufferSize
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = defaultWriteTimeout
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = defaultMinBackoff
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = defaultMaxBackoff
+	}
+	return c
+}
+
+type Error struct {
+	AppService appservice.AppService
+	Err        error
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("drain %s for app %s: %s", e.AppService.Id(), e.AppService.AppId, e.Err)
+}
+
+type drain struct {
+	appService appservice.AppService
+	writer     Writer
+	config     Config
+	messages   chan *logmessage.LogMessage
+	reportErr  func(Error)
+	done       chan struct{}
+}
+
+func newDrain(appService appservice.AppService, writer Writer, config Config, reportErr func(Error)) *drain {
+	return &drain{
+		appService: appService,
+		writer:     writer,
+		config:     config,
+		messages:   make(chan *logmessage.LogMessage, config.BufferSize),
+		reportErr:  reportErr,
+		done:       make(chan struct{}),
+	}
+}
+
+// forward queues a message for the drain, dropping it if the buffer is full so
+// that a slow drain never blocks the others.
+func (d *drain) forward(logMessage *logmessage.LogMessage) bool {
+	select {
+	case d.messages <- logMessage:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop does not wait for run to return, which takes until a pending connect
+// or write times out.
+func (d *drain) stop() {
+	close(d.done)
+}
+
+func (d *drain) run() {
+	defer d.writer.Close()
+
+	connected := false
+	failures := 0
+	for {
+		select {
+		case <-d.done:
+			return
+		case logMessage := <-d.messages:
+			for {
+				if !connected {
+					if err := d.writer.Connect(); err != nil {
+						d.reportErr(Error{AppService: d.appService, Err: err})
+						failures++
+						if !d.wait(backoff(failures, d.config.MinBackoff, d.config.MaxBackoff)) {
+							return
+						}
+						continue
+					}
+					connected = true
+				}
+
+				err := d.writer.Write(logMessage)
+				if err == nil {
+					failures = 0
+					break
+				}
+
+				d.reportErr(Error{AppService: d.appService, Err: err})
+				d.writer.Close()
+				connected = false
+				failures++
+				if !d.wait(backoff(failures, d.config.MinBackoff, d.config.MaxBackoff)) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *drain) wait(duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+func backoff(failures int, min, max time.Duration) time.Duration {
+	duration := min
+	for i := 1; i < failures; i++ {
+		duration *= 2
+		if duration >= max {
+			return max
+		}
+	}
+	return duration
+}
@@ -0,0 +1,151 @@
+package drain
+
+import (
+	"sync"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+// Manager keeps one drain per AppService, driven by the add and remove
+// channels of an AppServiceStoreWatcher.
+type Manager struct {
+	newWriter WriterFactory
+	config    Config
+	errors    chan Error
+	running   sync.WaitGroup
+
+	sync.RWMutex
+	drainsByAppId map[string]map[string]*drain
+}
+
+func NewManager(newWriter WriterFactory, config Config) *Manager {
+	config = config.withDefaults()
+	return &Manager{
+		newWriter:     newWriter,
+		config:        config,
+		errors:        make(chan Error, config.BufferSize),
+		drainsByAppId: make(map[string]map[string]*drain),
+	}
+}
+
+// Errors reports connection and write failures per drain. Errors are dropped
+// when nobody is reading. The channel is closed when Run returns.
+func (m *Manager) Errors() <-chan Error {
+	return m.errors
+}
+
+// Run blocks until both channels are closed, then stops all drains and waits
+// for them, including removed ones that are still finishing a connect or write.
+func (m *Manager) Run(addChan, removeChan <-chan appservice.AppService) {
+	defer close(m.errors)
+	defer m.stopAll()
+
+	for addChan != nil || removeChan != nil {
+		select {
+		case appService, ok := <-addChan:
+			if !ok {
+				addChan = nil
+				continue
+			}
+			m.add(appService)
+		case appService, ok := <-removeChan:
+			if !ok {
+				removeChan = nil
+				continue
+			}
+			m.remove(appService)
+		}
+	}
+}
+
+// Forward hands the message to every drain registered for its app. It never
+// blocks; messages for drains with a full buffer are dropped.
+func (m *Manager) Forward(logMessage *logmessage.LogMessage) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, d := range m.drainsByAppId[logMessage.GetAppId()] {
+		d.forward(logMessage)
+	}
+}
+
+func (m *Manager) Count() int {
+	m.RLock()
+	defer m.RUnlock()
+
+	count := 0
+	for _, drains := range m.drainsByAppId {
+		count += len(drains)
+	}
+	return count
+}
+
+func (m *Manager) add(appService appservice.AppService) {
+	m.Lock()
+	defer m.Unlock()
+
+	drains, ok := m.drainsByAppId[appService.AppId]
+	if !ok {
+		drains = make(map[string]*drain)
+		m.drainsByAppId[appService.AppId] = drains
+	}
+	if _, exists := drains[appService.Id()]; exists {
+		return
+	}
+
+	writer, err := m.newWriter(appService)
+	if err != nil {
+		m.reportErr(Error{AppService: appService, Err: err})
+		if len(drains) == 0 {
+			delete(m.drainsByAppId, appService.AppId)
+		}
+		return
+	}
+
+	d := newDrain(appService, writer, m.config, m.reportErr)
+	drains[appService.Id()] = d
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		d.run()
+	}()
+}
+
+func (m *Manager) remove(appService appservice.AppService) {
+	m.Lock()
+	drains := m.drainsByAppId[appService.AppId]
+	d, ok := drains[appService.Id()]
+	delete(drains, appService.Id())
+	if len(drains) == 0 {
+		delete(m.drainsByAppId, appService.AppId)
+	}
+	m.Unlock()
+
+	if ok {
+		d.stop()
+	}
+}
+
+func (m *Manager) stopAll() {
+	m.Lock()
+	drainsByAppId := m.drainsByAppId
+	m.drainsByAppId = make(map[string]map[string]*drain)
+	m.Unlock()
+
+	for _, drains := range drainsByAppId {
+		for _, d := range drains {
+			d.stop()
+		}
+	}
+	// removed drains may still be finishing a connect or write and report
+	// its failure
+	m.running.Wait()
+}
+
+func (m *Manager) reportErr(err Error) {
+	select {
+	case m.errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,257 @@
+package drain_test
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	. "github.com/cloudfoundry/loggregatorlib/drain"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Manager", func() {
+	var (
+		manager    *Manager
+		writers    map[string]*fakeWriter
+		writersMu  sync.Mutex
+		addChan    chan appservice.AppService
+		removeChan chan appservice.AppService
+		runDone    chan struct{}
+
+		app1Drain1, app1Drain2, app2Drain1 appservice.AppService
+	)
+
+	writerFor := func(appService appservice.AppService) *fakeWriter {
+		writersMu.Lock()
+		defer writersMu.Unlock()
+		return writers[appService.AppId+appService.Url]
+	}
+
+	BeforeEach(func() {
+		app1Drain1 = appservice.AppService{AppId: "app-1", Url: "syslog://example.com:514"}
+		app1Drain2 = appservice.AppService{AppId: "app-1", Url: "syslog://example.com:515"}
+		app2Drain1 = appservice.AppService{AppId: "app-2", Url: "syslog://example.com:514"}
+
+		writers = make(map[string]*fakeWriter)
+		factory := func(appService appservice.AppService) (Writer, error) {
+			if appService.Url == "bogus://" {
+				return nil, errors.New("unsupported")
+			}
+			writersMu.Lock()
+			defer writersMu.Unlock()
+			w := newFakeWriter()
+			writers[appService.AppId+appService.Url] = w
+			return w, nil
+		}
+
+		manager = NewManager(factory, Config{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+		addChan = make(chan appservice.AppService)
+		removeChan = make(chan appservice.AppService)
+		runDone = make(chan struct{})
+		go func() {
+			manager.Run(addChan, removeChan)
+			close(runDone)
+		}()
+	})
+
+	AfterEach(func() {
+		close(addChan)
+		close(removeChan)
+		Eventually(runDone).Should(BeClosed())
+	})
+
+	It("forwards messages only to the drains of the message's app", func() {
+		addChan <- app1Drain1
+		addChan <- app1Drain2
+		addChan <- app2Drain1
+		Eventually(manager.Count).Should(Equal(3))
+
+		manager.Forward(testhelpers.NewLogMessage("hello", "app-1"))
+
+		Eventually(writerFor(app1Drain1).Messages).Should(HaveLen(1))
+		Eventually(writerFor(app1Drain2).Messages).Should(HaveLen(1))
+		Consistently(writerFor(app2Drain1).Messages).Should(BeEmpty())
+	})
+
+	It("ignores duplicate adds", func() {
+		addChan <- app1Drain1
+		addChan <- app1Drain1
+		Consistently(manager.Count).Should(Equal(1))
+	})
+
+	It("stops and closes the writer when a drain is removed", func() {
+		addChan <- app1Drain1
+		Eventually(manager.Count).Should(Equal(1))
+
+		removeChan <- app1Drain1
+		Eventually(manager.Count).Should(BeZero())
+		Eventually(writerFor(app1Drain1).Closed).Should(BeTrue())
+	})
+
+	It("does not wait for a removed drain that is stuck connecting", func() {
+		addChan <- app1Drain1
+		Eventually(manager.Count).Should(Equal(1))
+		writerFor(app1Drain1).BlockConnects()
+		manager.Forward(testhelpers.NewLogMessage("hello", "app-1"))
+		Eventually(writerFor(app1Drain1).Connects).Should(Equal(1))
+
+		removeChan <- app1Drain1
+		added := make(chan struct{})
+		go func() {
+			addChan <- app2Drain1
+			close(added)
+		}()
+		Eventually(added).Should(BeClosed())
+		Eventually(manager.Count).Should(Equal(1))
+
+		writerFor(app1Drain1).UnblockConnects()
+		Eventually(writerFor(app1Drain1).Closed).Should(BeTrue())
+	})
+
+	It("reports drains that cannot be created", func() {
+		bogus := appservice.AppService{AppId: "app-1", Url: "bogus://"}
+		addChan <- bogus
+
+		var drainErr Error
+		Eventually(manager.Errors()).Should(Receive(&drainErr))
+		Expect(drainErr.AppService).To(Equal(bogus))
+		Expect(manager.Count()).To(BeZero())
+	})
+
+	It("reconnects with backoff and reports each failure", func() {
+		addChan <- app1Drain1
+		Eventually(manager.Count).Should(Equal(1))
+		writerFor(app1Drain1).FailConnects(2)
+
+		manager.Forward(testhelpers.NewLogMessage("hello", "app-1"))
+
+		var drainErr Error
+		Eventually(manager.Errors()).Should(Receive(&drainErr))
+		Expect(drainErr.AppService).To(Equal(app1Drain1))
+		Eventually(manager.Errors()).Should(Receive())
+		Eventually(writerFor(app1Drain1).Messages).Should(HaveLen(1))
+	})
+
+	It("retries a message after a failed write", func() {
+		addChan <- app1Drain1
+		Eventually(manager.Count).Should(Equal(1))
+		writerFor(app1Drain1).FailWrites(1)
+
+		manager.Forward(testhelpers.NewLogMessage("hello", "app-1"))
+
+		Eventually(manager.Errors()).Should(Receive())
+		Eventually(writerFor(app1Drain1).Messages).Should(HaveLen(1))
+		Expect(writerFor(app1Drain1).Connects()).To(Equal(2))
+	})
+
+	It("closes the errors channel once the input channels are closed", func() {
+		errs := manager.Errors()
+		close(addChan)
+		close(removeChan)
+		Eventually(errs).Should(BeClosed())
+
+		addChan = make(chan appservice.AppService)
+		removeChan = make(chan appservice.AppService)
+	})
+})
+
+type fakeWriter struct {
+	sync.Mutex
+	messages     []*logmessage.LogMessage
+	connects     int
+	failConnects int
+	failWrites   int
+	connected    bool
+	closed       bool
+	blocked      chan struct{}
+}
+
+func newFakeWriter() *fakeWriter {
+	return &fakeWriter{}
+}
+
+func (w *fakeWriter) Connect() error {
+	w.Lock()
+	defer w.Unlock()
+	w.connects++
+	if blocked := w.blocked; blocked != nil {
+		w.Unlock()
+		<-blocked
+		w.Lock()
+	}
+	if w.failConnects > 0 {
+		w.failConnects--
+		return errors.New("connection refused")
+	}
+	w.connected = true
+	return nil
+}
+
+func (w *fakeWriter) Write(logMessage *logmessage.LogMessage) error {
+	w.Lock()
+	defer w.Unlock()
+	if !w.connected {
+		return ErrNotConnected
+	}
+	if w.failWrites > 0 {
+		w.failWrites--
+		return errors.New("broken pipe")
+	}
+	w.messages = append(w.messages, logMessage)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	w.connected = false
+	w.closed = true
+	return nil
+}
+
+func (w *fakeWriter) Messages() []*logmessage.LogMessage {
+	w.Lock()
+	defer w.Unlock()
+	return w.messages
+}
+
+func (w *fakeWriter) Connects() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.connects
+}
+
+func (w *fakeWriter) Closed() bool {
+	w.Lock()
+	defer w.Unlock()
+	return w.closed
+}
+
+func (w *fakeWriter) BlockConnects() {
+	w.Lock()
+	defer w.Unlock()
+	w.blocked = make(chan struct{})
+}
+
+func (w *fakeWriter) UnblockConnects() {
+	w.Lock()
+	defer w.Unlock()
+	close(w.blocked)
+}
+
+func (w *fakeWriter) FailConnects(n int) {
+	w.Lock()
+	defer w.Unlock()
+	w.failConnects = n
+}
+
+func (w *fakeWriter) FailWrites(n int) {
+	w.Lock()
+	defer w.Unlock()
+	w.failWrites = n
+}
@@ -0,0 +1,148 @@
+package drain
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+var ErrNotConnected = errors.New("drain writer is not connected")
+
+type Writer interface {
+	Connect() error
+	Write(logMessage *logmessage.LogMessage) error
+	Close() error
+}
+
+type WriterFactory func(appService appservice.AppService) (Writer, error)
+
+func NewWriterFactory(config Config) WriterFactory {
+	config = config.withDefaults()
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipCertVerify}
+
+	return func(appService appservice.AppService) (Writer, error) {
+		u, err := url.Parse(appService.Url)
+		if err != nil {
+			return nil, err
+		}
+
+		switch u.Scheme {
+		case "syslog":
+			return newSyslogWriter(hostWithDefaultPort(u, "514"), nil, config), nil
+		case "syslog-tls":
+			return newSyslogWriter(hostWithDefaultPort(u, "6514"), tlsConfig, config), nil
+		case "https":
+			return newHttpsWriter(u.String(), tlsConfig, config), nil
+		default:
+			return nil, fmt.Errorf("unsupported drain scheme %q", u.Scheme)
+		}
+	}
+}
+
+type syslogWriter struct {
+	address   string
+	tlsConfig *tls.Config
+	config    Config
+	conn      net.Conn
+}
+
+func newSyslogWriter(address string, tlsConfig *tls.Config, config Config) *syslogWriter {
+	return &syslogWriter{address: address, tlsConfig: tlsConfig, config: config}
+}
+
+func (w *syslogWriter) Connect() error {
+	dialer := &net.Dialer{Timeout: w.config.DialTimeout}
+
+	var conn net.Conn
+	var err error
+	if w.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", w.address, w.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", w.address)
+	}
+	if err != nil {
+		return err
+	}
+
+	w.conn = conn
+	return nil
+}
+
+func (w *syslogWriter) Write(logMessage *logmessage.LogMessage) error {
+	if w.conn == nil {
+		return ErrNotConnected
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.config.WriteTimeout))
+	_, err := w.conn.Write(logmessage.FormatSyslogFrame(logMessage, logmessage.SyslogFramingOctetCounting))
+	return err
+}
+
+func (w *syslogWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+type httpsWriter struct {
+	url       string
+	client    *http.Client
+	transport *http.Transport
+}
+
+func newHttpsWriter(url string, tlsConfig *tls.Config, config Config) *httpsWriter {
+	transport := &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Dial:            (&net.Dialer{Timeout: config.DialTimeout}).Dial,
+	}
+	return &httpsWriter{
+		url:       url,
+		client:    &http.Client{Timeout: config.DialTimeout + config.WriteTimeout, Transport: transport},
+		transport: transport,
+	}
+}
+
+func (w *httpsWriter) Connect() error {
+	return nil
+}
+
+func (w *httpsWriter) Write(logMessage *logmessage.LogMessage) error {
+	resp, err := w.client.Post(w.url, "text/plain", bytes.NewReader(logmessage.FormatSyslog(logMessage)))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("drain responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close drops the kept-alive connections, which would otherwise stay open
+// until the drain closes them.
+func (w *httpsWriter) Close() error {
+	w.transport.CloseIdleConnections()
+	return nil
+}
+
+func hostWithDefaultPort(u *url.URL, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(u.Host); err == nil {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
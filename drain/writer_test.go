@@ -0,0 +1,144 @@
+package drain_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	. "github.com/cloudfoundry/loggregatorlib/drain"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Writer", func() {
+	var newWriter WriterFactory
+
+	BeforeEach(func() {
+		newWriter = NewWriterFactory(Config{SkipCertVerify: true})
+	})
+
+	It("rejects unsupported schemes", func() {
+		_, err := newWriter(appservice.AppService{AppId: "app-1", Url: "ftp://example.com"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("syslog://", func() {
+		var listener net.Listener
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			listener.Close()
+		})
+
+		It("writes octet-counted RFC 5424 messages", func() {
+			received := make(chan *logmessage.LogMessage, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				logMessage, err := logmessage.NewSyslogReader(conn, logmessage.SyslogFramingOctetCounting).Read()
+				if err == nil {
+					received <- logMessage
+				}
+			}()
+
+			writer, err := newWriter(appservice.AppService{AppId: "app-1", Url: "syslog://" + listener.Addr().String()})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(testhelpers.NewLogMessage("hello", "app-1"))).To(Equal(ErrNotConnected))
+
+			Expect(writer.Connect()).To(Succeed())
+			defer writer.Close()
+			Expect(writer.Write(testhelpers.NewLogMessage("hello", "app-1"))).To(Succeed())
+
+			var logMessage *logmessage.LogMessage
+			Eventually(received).Should(Receive(&logMessage))
+			Expect(logMessage.GetAppId()).To(Equal("app-1"))
+			Expect(logMessage.GetMessage()).To(Equal([]byte("hello")))
+		})
+
+		It("fails to connect when nobody is listening", func() {
+			address := listener.Addr().String()
+			listener.Close()
+
+			writer, err := newWriter(appservice.AppService{AppId: "app-1", Url: "syslog://" + address})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Connect()).NotTo(Succeed())
+		})
+	})
+
+	Describe("https://", func() {
+		var (
+			testServer *httptest.Server
+			bodies     chan string
+			status     int
+			closed     chan net.Conn
+		)
+
+		BeforeEach(func() {
+			bodies = make(chan string, 1)
+			status = http.StatusOK
+			closed = make(chan net.Conn, 1)
+			testServer = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				bodies <- string(body)
+				rw.WriteHeader(status)
+			}))
+			testServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateClosed {
+					select {
+					case closed <- conn:
+					default:
+					}
+				}
+			}
+			testServer.StartTLS()
+		})
+
+		AfterEach(func() {
+			testServer.Close()
+		})
+
+		It("posts each message as a syslog line", func() {
+			writer, err := newWriter(appservice.AppService{AppId: "app-1", Url: testServer.URL})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Connect()).To(Succeed())
+
+			Expect(writer.Write(testhelpers.NewLogMessage("hello", "app-1"))).To(Succeed())
+
+			var body string
+			Eventually(bodies).Should(Receive(&body))
+			Expect(body).To(MatchRegexp(`^<14>1 \S+ app-1 App - - - hello$`))
+		})
+
+		It("closes its connections when it is closed", func() {
+			writer, err := newWriter(appservice.AppService{AppId: "app-1", Url: testServer.URL})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(testhelpers.NewLogMessage("hello", "app-1"))).To(Succeed())
+			Eventually(bodies).Should(Receive())
+			Consistently(closed).ShouldNot(Receive())
+
+			Expect(writer.Close()).To(Succeed())
+			Eventually(closed).Should(Receive())
+		})
+
+		It("fails on non-2xx responses", func() {
+			status = http.StatusInternalServerError
+			writer, err := newWriter(appservice.AppService{AppId: "app-1", Url: testServer.URL})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(writer.Write(testhelpers.NewLogMessage("hello", "app-1"))).NotTo(Succeed())
+		})
+	})
+})
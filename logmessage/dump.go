@@ -13,6 +13,13 @@ func DumpMessage(msg Message, buffer *bytes.Buffer) {
 }
 
 func ParseDumpedLogMessages(b []byte) (messages []*LogMessage, err error) {
+	if IsVersionedDump(b) {
+		return parseVersionedDump(b)
+	}
+	return parseLegacyDump(b)
+}
+
+func parseLegacyDump(b []byte) (messages []*LogMessage, err error) {
 	buffer := bytes.NewBuffer(b)
 	var length uint32
 	for buffer.Len() > 0 {
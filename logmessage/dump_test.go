@@ -0,0 +1,128 @@
+package logmessage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLegacyDumpRoundTrip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	DumpMessage(*newTimestampedMessage(t, "first", "app-1", 1), buffer)
+	DumpMessage(*newTimestampedMessage(t, "second", "app-1", 2), buffer)
+
+	assert.False(t, IsVersionedDump(buffer.Bytes()))
+
+	messages, err := ParseDumpedLogMessages(buffer.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("first"), messages[0].GetMessage())
+	assert.Equal(t, []byte("second"), messages[1].GetMessage())
+}
+
+func TestVersionedDumpRoundTrip(t *testing.T) {
+	dump := writeVersionedDump(t, false,
+		newTimestampedMessage(t, "first", "app-1", 1),
+		newTimestampedMessage(t, "second", "app-2", 2),
+	)
+
+	assert.True(t, IsVersionedDump(dump))
+	assert.NoError(t, VerifyDump(dump))
+
+	messages, err := ParseDumpedLogMessages(dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []byte("first"), messages[0].GetMessage())
+	assert.Equal(t, "app-2", messages[1].GetAppId())
+}
+
+func TestVersionedDumpDetectsCorruptFrames(t *testing.T) {
+	dump := writeVersionedDump(t, false, newTimestampedMessage(t, "first", "app-1", 1))
+	dump[dumpHeaderLength+dumpFrameHeaderLength+2] ^= 0xff
+
+	assert.Equal(t, ErrDumpChecksumMismatch, VerifyDump(dump))
+
+	_, err := ParseDumpedLogMessages(dump)
+	assert.Equal(t, ErrDumpChecksumMismatch, err)
+}
+
+func TestVersionedDumpDetectsTruncation(t *testing.T) {
+	dump := writeVersionedDump(t, false, newTimestampedMessage(t, "first", "app-1", 1))
+
+	assert.Equal(t, ErrDumpTruncated, VerifyDump(dump[:len(dump)-6]))
+}
+
+func TestVersionedDumpRejectsUnknownVersions(t *testing.T) {
+	dump := writeVersionedDump(t, false, newTimestampedMessage(t, "first", "app-1", 1))
+	dump[9] = 99
+
+	_, err := ParseDumpedLogMessages(dump)
+	assert.Equal(t, ErrDumpUnsupportedVersion, err)
+}
+
+func TestVersionedDumpIndex(t *testing.T) {
+	dump := writeVersionedDump(t, true,
+		newTimestampedMessage(t, "first", "app-2", 30),
+		newTimestampedMessage(t, "second", "app-1", 10),
+		newTimestampedMessage(t, "third", "app-2", 20),
+	)
+	assert.NoError(t, VerifyDump(dump))
+
+	index, err := ReadDumpIndex(dump)
+	assert.NoError(t, err)
+	assert.Equal(t, []DumpIndexEntry{
+		{AppId: "app-1", MessageCount: 1, FirstTimestamp: 10, LastTimestamp: 10},
+		{AppId: "app-2", MessageCount: 2, FirstTimestamp: 20, LastTimestamp: 30},
+	}, index.Entries)
+
+	entry, ok := index.Find("app-2")
+	assert.True(t, ok)
+	assert.True(t, entry.Overlaps(time.Unix(0, 25), time.Unix(0, 40)))
+	assert.False(t, entry.Overlaps(time.Unix(0, 31), time.Unix(0, 40)))
+
+	_, ok = index.Find("app-3")
+	assert.False(t, ok)
+
+	messages, err := ParseDumpedLogMessages(dump)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(messages))
+}
+
+func TestVersionedDumpWithoutIndex(t *testing.T) {
+	dump := writeVersionedDump(t, false, newTimestampedMessage(t, "first", "app-1", 1))
+
+	_, err := ReadDumpIndex(dump)
+	assert.Equal(t, ErrDumpNoIndex, err)
+}
+
+func TestVersionedDumpDetectsCorruptIndex(t *testing.T) {
+	dump := writeVersionedDump(t, true, newTimestampedMessage(t, "first", "app-1", 1))
+	dump[len(dump)-dumpIndexFooterLength-1] ^= 0xff
+
+	_, err := ReadDumpIndex(dump)
+	assert.Equal(t, ErrDumpChecksumMismatch, err)
+	assert.Equal(t, ErrDumpChecksumMismatch, VerifyDump(dump))
+}
+
+func writeVersionedDump(t *testing.T, indexed bool, messages ...*Message) []byte {
+	buffer := &bytes.Buffer{}
+	writer, err := NewDumpWriter(buffer, indexed)
+	assert.NoError(t, err)
+
+	for _, message := range messages {
+		assert.NoError(t, writer.Write(message))
+	}
+	assert.NoError(t, writer.Close())
+
+	return buffer.Bytes()
+}
+
+func newTimestampedMessage(t *testing.T, messageString, appId string, timestamp int64) *Message {
+	logMessage := NewLogMessageWithSourceName(t, messageString, "App", appId)
+	logMessage.Timestamp = proto.Int64(timestamp)
+
+	return NewMessage(logMessage, MarshallLogMessage(t, logMessage))
+}
@@ -0,0 +1,202 @@
+package logmessage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+const (
+	JSONEncodingUTF8   = "utf8"
+	JSONEncodingBase64 = "base64"
+)
+
+type jsonLogMessage struct {
+	Message         string   `json:"message"`
+	MessageEncoding string   `json:"message_encoding"`
+	MessageType     string   `json:"message_type"`
+	Timestamp       string   `json:"timestamp"`
+	AppId           string   `json:"app_id"`
+	SourceName      *string  `json:"source_name,omitempty"`
+	SourceId        *string  `json:"source_id,omitempty"`
+	DrainUrls       []string `json:"drain_urls,omitempty"`
+}
+
+type jsonLogEnvelope struct {
+	RoutingKey string          `json:"routing_key"`
+	Signature  []byte          `json:"signature"`
+	LogMessage *jsonLogMessage `json:"log_message"`
+}
+
+func MarshalLogMessageJSON(logMessage *LogMessage) ([]byte, error) {
+	return json.Marshal(toJSONLogMessage(logMessage))
+}
+
+func UnmarshalLogMessageJSON(data []byte) (*LogMessage, error) {
+	jsonMessage := &jsonLogMessage{}
+	if err := json.Unmarshal(data, jsonMessage); err != nil {
+		return nil, err
+	}
+	return fromJSONLogMessage(jsonMessage)
+}
+
+func MarshalLogEnvelopeJSON(envelope *LogEnvelope) ([]byte, error) {
+	if envelope.GetLogMessage() == nil {
+		return nil, errors.New("envelope has no log message")
+	}
+	return json.Marshal(&jsonLogEnvelope{
+		RoutingKey: envelope.GetRoutingKey(),
+		Signature:  envelope.GetSignature(),
+		LogMessage: toJSONLogMessage(envelope.GetLogMessage()),
+	})
+}
+
+func UnmarshalLogEnvelopeJSON(data []byte) (*LogEnvelope, error) {
+	jsonEnvelope := &jsonLogEnvelope{}
+	if err := json.Unmarshal(data, jsonEnvelope); err != nil {
+		return nil, err
+	}
+	if jsonEnvelope.LogMessage == nil {
+		return nil, errors.New("envelope has no log message")
+	}
+
+	logMessage, err := fromJSONLogMessage(jsonEnvelope.LogMessage)
+	if err != nil {
+		return nil, err
+	}
+	return &LogEnvelope{
+		RoutingKey: proto.String(jsonEnvelope.RoutingKey),
+		Signature:  jsonEnvelope.Signature,
+		LogMessage: logMessage,
+	}, nil
+}
+
+// ParseMessageJSON is the JSON counterpart of ParseMessage. The raw message of
+// the result is the protobuf encoding of the decoded LogMessage.
+func ParseMessageJSON(data []byte) (*Message, error) {
+	logMessage, err := UnmarshalLogMessageJSON(data)
+	if err != nil {
+		return nil, err
+	}
+
+	rawMessage, err := proto.Marshal(logMessage)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(logMessage, rawMessage), nil
+}
+
+func (m *Message) MarshalJSON() ([]byte, error) {
+	return MarshalLogMessageJSON(m.logMessage)
+}
+
+type NDJSONEncoder struct {
+	encoder *json.Encoder
+}
+
+func NewNDJSONEncoder(w io.Writer) *NDJSONEncoder {
+	return &NDJSONEncoder{encoder: json.NewEncoder(w)}
+}
+
+func (e *NDJSONEncoder) Encode(logMessage *LogMessage) error {
+	return e.encoder.Encode(toJSONLogMessage(logMessage))
+}
+
+type NDJSONDecoder struct {
+	decoder *json.Decoder
+}
+
+func NewNDJSONDecoder(r io.Reader) *NDJSONDecoder {
+	return &NDJSONDecoder{decoder: json.NewDecoder(r)}
+}
+
+// Decode returns the next message in the stream, or io.EOF once the stream is
+// exhausted.
+func (d *NDJSONDecoder) Decode() (*Message, error) {
+	var line json.RawMessage
+	if err := d.decoder.Decode(&line); err != nil {
+		return nil, err
+	}
+	return ParseMessageJSON(line)
+}
+
+func DumpToNDJSON(dump []byte, w io.Writer) error {
+	messages, err := ParseDumpedLogMessages(dump)
+	if err != nil {
+		return err
+	}
+
+	encoder := NewNDJSONEncoder(w)
+	for _, message := range messages {
+		if err := encoder.Encode(message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toJSONLogMessage(logMessage *LogMessage) *jsonLogMessage {
+	jsonMessage := &jsonLogMessage{
+		MessageType: logMessage.GetMessageType().String(),
+		Timestamp:   time.Unix(0, logMessage.GetTimestamp()).UTC().Format(time.RFC3339Nano),
+		AppId:       logMessage.GetAppId(),
+		SourceName:  logMessage.SourceName,
+		SourceId:    logMessage.SourceId,
+		DrainUrls:   logMessage.GetDrainUrls(),
+	}
+
+	if utf8.Valid(logMessage.GetMessage()) {
+		jsonMessage.Message = string(logMessage.GetMessage())
+		jsonMessage.MessageEncoding = JSONEncodingUTF8
+	} else {
+		jsonMessage.Message = base64.StdEncoding.EncodeToString(logMessage.GetMessage())
+		jsonMessage.MessageEncoding = JSONEncodingBase64
+	}
+	return jsonMessage
+}
+
+func fromJSONLogMessage(jsonMessage *jsonLogMessage) (*LogMessage, error) {
+	var message []byte
+	switch jsonMessage.MessageEncoding {
+	case JSONEncodingUTF8, "":
+		message = []byte(jsonMessage.Message)
+	case JSONEncodingBase64:
+		var err error
+		message, err = base64.StdEncoding.DecodeString(jsonMessage.Message)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown message encoding %q", jsonMessage.MessageEncoding)
+	}
+
+	messageType, ok := LogMessage_MessageType_value[jsonMessage.MessageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", jsonMessage.MessageType)
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, jsonMessage.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if jsonMessage.AppId == "" {
+		return nil, errors.New("missing app_id")
+	}
+
+	return &LogMessage{
+		Message:     message,
+		MessageType: LogMessage_MessageType(messageType).Enum(),
+		Timestamp:   proto.Int64(timestamp.UnixNano()),
+		AppId:       proto.String(jsonMessage.AppId),
+		SourceName:  jsonMessage.SourceName,
+		SourceId:    jsonMessage.SourceId,
+		DrainUrls:   jsonMessage.DrainUrls,
+	}, nil
+}
@@ -0,0 +1,123 @@
+package logmessage
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogMessageJSONMapping(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello", "App", "my-app")
+	logMessage.Timestamp = proto.Int64(1400000000123456789)
+	logMessage.SourceId = proto.String("0")
+
+	data, err := MarshalLogMessageJSON(logMessage)
+	assert.NoError(t, err)
+
+	var fields map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &fields))
+	assert.Equal(t, map[string]interface{}{
+		"message":          "hello",
+		"message_encoding": "utf8",
+		"message_type":     "OUT",
+		"timestamp":        "2014-05-13T16:53:20.123456789Z",
+		"app_id":           "my-app",
+		"source_name":      "App",
+		"source_id":        "0",
+	}, fields)
+}
+
+func TestLogMessageJSONUsesBase64ForBinaryMessages(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "\xff\xfe", "App", "my-app")
+
+	data, err := MarshalLogMessageJSON(logMessage)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"message":"//4="`)
+	assert.Contains(t, string(data), `"message_encoding":"base64"`)
+
+	decoded, err := UnmarshalLogMessageJSON(data)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\xff\xfe"), decoded.GetMessage())
+}
+
+func TestLogMessageJSONRoundTrip(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello", "App", "my-app")
+	logMessage.DrainUrls = []string{"syslog://example.com:514"}
+
+	data, err := MarshalLogMessageJSON(logMessage)
+	assert.NoError(t, err)
+
+	decoded, err := UnmarshalLogMessageJSON(data)
+	assert.NoError(t, err)
+	assert.Equal(t, logMessage, decoded)
+}
+
+func TestLogMessageJSONRejectsUnknownTypes(t *testing.T) {
+	_, err := UnmarshalLogMessageJSON([]byte(`{"message":"hi","message_type":"DEBUG","timestamp":"2014-05-13T16:53:20Z","app_id":"my-app"}`))
+	assert.Error(t, err)
+}
+
+func TestParseMessageJSONSetsRawMessage(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello", "App", "my-app")
+	data, err := MarshalLogMessageJSON(logMessage)
+	assert.NoError(t, err)
+
+	message, err := ParseMessageJSON(data)
+	assert.NoError(t, err)
+	assert.Equal(t, MarshallLogMessage(t, logMessage), message.GetRawMessage())
+	assert.Equal(t, uint32(len(message.GetRawMessage())), message.GetRawMessageLength())
+}
+
+func TestLogEnvelopeJSONRoundTrip(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello", "App", "my-app")
+	envelope := UnmarshalLogEnvelope(t, MarshalledLogEnvelope(t, logMessage, "secret"))
+
+	data, err := MarshalLogEnvelopeJSON(envelope)
+	assert.NoError(t, err)
+
+	decoded, err := UnmarshalLogEnvelopeJSON(data)
+	assert.NoError(t, err)
+	assert.Equal(t, envelope.GetRoutingKey(), decoded.GetRoutingKey())
+	assert.Equal(t, envelope.GetLogMessage(), decoded.GetLogMessage())
+	assert.True(t, decoded.VerifySignature("secret"))
+}
+
+func TestNDJSONRoundTrip(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	encoder := NewNDJSONEncoder(buffer)
+	assert.NoError(t, encoder.Encode(NewLogMessageWithSourceName(t, "first", "App", "my-app")))
+	assert.NoError(t, encoder.Encode(NewLogMessageWithSourceName(t, "second", "App", "my-app")))
+
+	assert.Equal(t, 2, bytes.Count(buffer.Bytes(), []byte("\n")))
+
+	decoder := NewNDJSONDecoder(buffer)
+	message, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("first"), message.GetLogMessage().GetMessage())
+
+	message, err = decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("second"), message.GetLogMessage().GetMessage())
+
+	_, err = decoder.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDumpToNDJSON(t *testing.T) {
+	dump := writeVersionedDump(t, false,
+		newTimestampedMessage(t, "first", "app-1", 1),
+		newTimestampedMessage(t, "second", "app-1", 2),
+	)
+
+	buffer := &bytes.Buffer{}
+	assert.NoError(t, DumpToNDJSON(dump, buffer))
+
+	decoder := NewNDJSONDecoder(buffer)
+	message, err := decoder.Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), message.GetLogMessage().GetTimestamp())
+}
@@ -0,0 +1,274 @@
+package logmessage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+type SyslogFraming int
+
+const (
+	SyslogFramingOctetCounting SyslogFraming = iota
+	SyslogFramingNewline
+)
+
+const (
+	syslogVersion      = "1"
+	syslogNilValue     = "-"
+	syslogTimeFormat   = "2006-01-02T15:04:05.999999Z07:00"
+	syslogFacilityUser = 1
+	syslogSeverityErr  = 3
+	syslogSeverityInfo = 6
+
+	syslogMaxHostnameLength = 255
+	syslogMaxAppNameLength  = 48
+	syslogMaxProcIdLength   = 128
+	syslogMaxFrameLength    = 1024 * 1024
+)
+
+var ErrInvalidSyslogMessage = errors.New("invalid RFC 5424 syslog message")
+
+// syslogLineSeparator (U+2028) stands in for the newlines of multi-line
+// messages with newline framing, which would otherwise end the frame.
+var syslogLineSeparator = []byte("\u2028")
+
+// FormatSyslog renders a LogMessage as an unframed RFC 5424 line. The app id
+// becomes the HOSTNAME, the source name the APP-NAME and the source id the
+// PROCID; ERR messages are logged at severity error, OUT at informational.
+func FormatSyslog(logMessage *LogMessage) []byte {
+	severity := syslogSeverityInfo
+	if logMessage.GetMessageType() == LogMessage_ERR {
+		severity = syslogSeverityErr
+	}
+
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "<%d>%s %s %s %s %s %s %s ",
+		syslogFacilityUser*8+severity,
+		syslogVersion,
+		time.Unix(0, logMessage.GetTimestamp()).UTC().Format(syslogTimeFormat),
+		syslogHeaderField(logMessage.GetAppId(), syslogMaxHostnameLength),
+		syslogHeaderField(logMessage.GetSourceName(), syslogMaxAppNameLength),
+		syslogHeaderField(logMessage.GetSourceId(), syslogMaxProcIdLength),
+		syslogNilValue,
+		syslogNilValue,
+	)
+	buffer.Write(logMessage.GetMessage())
+	return buffer.Bytes()
+}
+
+// FormatSyslogFrame frames the line for a stream. With newline framing the
+// newlines of the message are sent as U+2028 LINE SEPARATOR and turned back
+// into newlines by SyslogReader; octet counting sends the message as it is.
+func FormatSyslogFrame(logMessage *LogMessage, framing SyslogFraming) []byte {
+	line := FormatSyslog(logMessage)
+	if framing == SyslogFramingNewline {
+		return append(bytes.Replace(line, []byte("\n"), syslogLineSeparator, -1), '\n')
+	}
+	return append([]byte(strconv.Itoa(len(line))+" "), line...)
+}
+
+func ParseSyslog(line []byte) (*LogMessage, error) {
+	parser := &syslogParser{data: line}
+
+	priority, err := parser.priority()
+	if err != nil {
+		return nil, err
+	}
+	if version := parser.field(); version != syslogVersion {
+		return nil, ErrInvalidSyslogMessage
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, parser.field())
+	if err != nil {
+		return nil, ErrInvalidSyslogMessage
+	}
+
+	hostname := parser.field()
+	if hostname == "" || hostname == syslogNilValue {
+		return nil, ErrInvalidSyslogMessage
+	}
+	appName := parser.field()
+	procId := parser.field()
+	if msgId := parser.field(); msgId == "" {
+		return nil, ErrInvalidSyslogMessage
+	}
+	if err := parser.skipStructuredData(); err != nil {
+		return nil, err
+	}
+
+	messageType := LogMessage_OUT
+	if priority%8 <= syslogSeverityErr {
+		messageType = LogMessage_ERR
+	}
+
+	logMessage := &LogMessage{
+		Message:     parser.message(),
+		MessageType: &messageType,
+		Timestamp:   proto.Int64(timestamp.UnixNano()),
+		AppId:       proto.String(hostname),
+	}
+	if appName != syslogNilValue {
+		logMessage.SourceName = proto.String(appName)
+	}
+	if procId != syslogNilValue {
+		logMessage.SourceId = proto.String(procId)
+	}
+	return logMessage, nil
+}
+
+type SyslogReader struct {
+	reader  *bufio.Reader
+	framing SyslogFraming
+}
+
+func NewSyslogReader(r io.Reader, framing SyslogFraming) *SyslogReader {
+	return &SyslogReader{reader: bufio.NewReader(r), framing: framing}
+}
+
+// Read returns the next framed message, or io.EOF once the stream is exhausted.
+func (r *SyslogReader) Read() (*LogMessage, error) {
+	line, err := r.nextFrame()
+	if err != nil {
+		return nil, err
+	}
+	return ParseSyslog(line)
+}
+
+func (r *SyslogReader) nextFrame() ([]byte, error) {
+	if r.framing == SyslogFramingNewline {
+		line, err := r.reader.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		return bytes.Replace(bytes.TrimRight(line, "\r\n"), syslogLineSeparator, []byte("\n"), -1), err
+	}
+
+	lengthField, err := r.reader.ReadString(' ')
+	if err != nil {
+		if err == io.EOF && len(lengthField) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	length, err := strconv.Atoi(lengthField[:len(lengthField)-1])
+	if err != nil || length <= 0 || length > syslogMaxFrameLength {
+		return nil, ErrInvalidSyslogMessage
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+type syslogParser struct {
+	data   []byte
+	offset int
+}
+
+func (p *syslogParser) priority() (int, error) {
+	if len(p.data) < 3 || p.data[0] != '<' {
+		return 0, ErrInvalidSyslogMessage
+	}
+	end := bytes.IndexByte(p.data, '>')
+	if end < 2 || end > 4 {
+		return 0, ErrInvalidSyslogMessage
+	}
+	priority, err := strconv.Atoi(string(p.data[1:end]))
+	if err != nil || priority < 0 || priority > 191 {
+		return 0, ErrInvalidSyslogMessage
+	}
+	p.offset = end + 1
+	return priority, nil
+}
+
+// field returns the next space separated header field, or "" if there is none.
+func (p *syslogParser) field() string {
+	if p.offset >= len(p.data) {
+		return ""
+	}
+	end := bytes.IndexByte(p.data[p.offset:], ' ')
+	if end < 0 {
+		end = len(p.data) - p.offset
+	}
+	field := string(p.data[p.offset : p.offset+end])
+	p.offset += end + 1
+	return field
+}
+
+func (p *syslogParser) skipStructuredData() error {
+	if p.offset >= len(p.data) {
+		return ErrInvalidSyslogMessage
+	}
+	if p.data[p.offset] == '-' {
+		p.offset++
+		return p.skipSpace()
+	}
+	if p.data[p.offset] != '[' {
+		return ErrInvalidSyslogMessage
+	}
+
+	for p.offset < len(p.data) && p.data[p.offset] == '[' {
+		inQuotes := false
+		for p.offset++; ; p.offset++ {
+			if p.offset >= len(p.data) {
+				return ErrInvalidSyslogMessage
+			}
+			c := p.data[p.offset]
+			if inQuotes && c == '\\' {
+				p.offset++
+				continue
+			}
+			if c == '"' {
+				inQuotes = !inQuotes
+			}
+			if c == ']' && !inQuotes {
+				p.offset++
+				break
+			}
+		}
+	}
+	return p.skipSpace()
+}
+
+func (p *syslogParser) skipSpace() error {
+	if p.offset >= len(p.data) {
+		return nil
+	}
+	if p.data[p.offset] != ' ' {
+		return ErrInvalidSyslogMessage
+	}
+	p.offset++
+	return nil
+}
+
+func (p *syslogParser) message() []byte {
+	message := p.data[p.offset:]
+	message = bytes.TrimPrefix(message, []byte("\xef\xbb\xbf"))
+	return append([]byte{}, message...)
+}
+
+func syslogHeaderField(value string, maxLength int) string {
+	if value == "" {
+		return syslogNilValue
+	}
+
+	field := []byte(value)
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	if len(field) > maxLength {
+		field = field[:maxLength]
+	}
+	return string(field)
+}
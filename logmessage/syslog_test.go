@@ -0,0 +1,116 @@
+package logmessage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSyslog(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello world", "App", "my-app")
+	logMessage.Timestamp = proto.Int64(1400000000123456789)
+	logMessage.SourceId = proto.String("0")
+
+	assert.Equal(t, "<14>1 2014-05-13T16:53:20.123456Z my-app App 0 - - hello world", string(FormatSyslog(logMessage)))
+
+	logMessage.MessageType = LogMessage_ERR.Enum()
+	logMessage.SourceId = nil
+	assert.Equal(t, "<11>1 2014-05-13T16:53:20.123456Z my-app App - - - hello world", string(FormatSyslog(logMessage)))
+}
+
+func TestFormatSyslogSanitizesHeaderFields(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello", "App Staging", "my-app")
+	logMessage.Timestamp = proto.Int64(0)
+
+	assert.Contains(t, string(FormatSyslog(logMessage)), " my-app App_Staging - - - hello")
+}
+
+func TestFormatSyslogFrame(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello", "App", "my-app")
+	logMessage.Timestamp = proto.Int64(1400000000123456789)
+	line := "<14>1 2014-05-13T16:53:20.123456Z my-app App - - - hello"
+
+	assert.Equal(t, line+"\n", string(FormatSyslogFrame(logMessage, SyslogFramingNewline)))
+	assert.Equal(t, "56 "+line, string(FormatSyslogFrame(logMessage, SyslogFramingOctetCounting)))
+}
+
+func TestParseSyslogRoundTrip(t *testing.T) {
+	logMessage := NewLogMessageWithSourceName(t, "hello world", "App", "my-app")
+	logMessage.Timestamp = proto.Int64(1400000000123456000)
+	logMessage.SourceId = proto.String("3")
+	logMessage.MessageType = LogMessage_ERR.Enum()
+
+	parsed, err := ParseSyslog(FormatSyslog(logMessage))
+	assert.NoError(t, err)
+	assert.Equal(t, logMessage, parsed)
+}
+
+func TestParseSyslogWithStructuredData(t *testing.T) {
+	line := `<165>1 2003-10-11T22:14:15.003Z my-app evntslog - ID47 [exampleSDID@32473 iut="3" eventID="10\]11"][other@1 a="b"] An application event`
+
+	logMessage, err := ParseSyslog([]byte(line))
+	assert.NoError(t, err)
+	assert.Equal(t, "my-app", logMessage.GetAppId())
+	assert.Equal(t, "evntslog", logMessage.GetSourceName())
+	assert.Nil(t, logMessage.SourceId)
+	assert.Equal(t, LogMessage_OUT, logMessage.GetMessageType())
+	assert.Equal(t, []byte("An application event"), logMessage.GetMessage())
+}
+
+func TestParseSyslogRejectsInvalidLines(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"hello",
+		"<14>2 2014-05-13T16:53:20Z my-app App - - - hello",
+		"<14>1 yesterday my-app App - - - hello",
+		"<14>1 2014-05-13T16:53:20Z - App - - - hello",
+		"<14>1 2014-05-13T16:53:20Z my-app App - - [unterminated hello",
+	} {
+		_, err := ParseSyslog([]byte(line))
+		assert.Equal(t, ErrInvalidSyslogMessage, err, line)
+	}
+}
+
+func TestSyslogReader(t *testing.T) {
+	first := NewLogMessageWithSourceName(t, "first", "App", "my-app")
+	second := NewLogMessageWithSourceName(t, "second", "App", "my-app")
+
+	for _, framing := range []SyslogFraming{SyslogFramingNewline, SyslogFramingOctetCounting} {
+		stream := append(FormatSyslogFrame(first, framing), FormatSyslogFrame(second, framing)...)
+		reader := NewSyslogReader(bytes.NewReader(stream), framing)
+
+		logMessage, err := reader.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("first"), logMessage.GetMessage())
+
+		logMessage, err = reader.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("second"), logMessage.GetMessage())
+
+		_, err = reader.Read()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func TestSyslogReaderMultiLineMessages(t *testing.T) {
+	multiLine := NewLogMessageWithSourceName(t, "line one\nline two\n", "App", "my-app")
+	next := NewLogMessageWithSourceName(t, "next", "App", "my-app")
+
+	for _, framing := range []SyslogFraming{SyslogFramingNewline, SyslogFramingOctetCounting} {
+		stream := append(FormatSyslogFrame(multiLine, framing), FormatSyslogFrame(next, framing)...)
+		reader := NewSyslogReader(bytes.NewReader(stream), framing)
+
+		logMessage, err := reader.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("line one\nline two\n"), logMessage.GetMessage())
+
+		logMessage, err = reader.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("next"), logMessage.GetMessage())
+	}
+
+	assert.Equal(t, 1, bytes.Count(FormatSyslogFrame(multiLine, SyslogFramingNewline), []byte("\n")))
+}
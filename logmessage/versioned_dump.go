@@ -0,0 +1,366 @@
+package logmessage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+// A versioned dump is laid out as follows (all integers big-endian):
+//
+//	header: magic (8 bytes) | version (uint16) | flags (uint16)
+//	frame:  length (uint32) | crc32 of the message (uint32) | LogMessage protobuf
+//	end:    length 0 (uint32)
+//	index:  index bytes | index length (uint32) | crc32 of the index (uint32) | "LGIX"
+//
+// The index is only present when the header carries DumpFlagIndexed. The magic
+// starts with 0xff so a versioned dump can never be mistaken for a legacy dump,
+// whose first four bytes are the length of the first message.
+
+const (
+	DumpFormatVersion uint16 = 2
+
+	DumpFlagIndexed uint16 = 1 << 0
+)
+
+const (
+	dumpHeaderLength      = 12
+	dumpFrameHeaderLength = 8
+	dumpIndexFooterLength = 12
+)
+
+var (
+	dumpMagic      = []byte{0xff, 'L', 'G', 'R', 'D', 'U', 'M', 'P'}
+	dumpIndexMagic = []byte("LGIX")
+)
+
+var (
+	ErrDumpInvalidHeader      = errors.New("dump: invalid header")
+	ErrDumpUnsupportedVersion = errors.New("dump: unsupported format version")
+	ErrDumpTruncated          = errors.New("dump: truncated")
+	ErrDumpChecksumMismatch   = errors.New("dump: checksum mismatch")
+	ErrDumpTrailingData       = errors.New("dump: unexpected data after end marker")
+	ErrDumpNoIndex            = errors.New("dump: no index")
+	ErrDumpEmptyMessage       = errors.New("dump: cannot write an empty message")
+)
+
+type DumpWriter struct {
+	writer  io.Writer
+	indexed bool
+	index   map[string]*DumpIndexEntry
+}
+
+func NewDumpWriter(w io.Writer, indexed bool) (*DumpWriter, error) {
+	var flags uint16
+	if indexed {
+		flags |= DumpFlagIndexed
+	}
+
+	header := make([]byte, dumpHeaderLength)
+	copy(header, dumpMagic)
+	binary.BigEndian.PutUint16(header[8:], DumpFormatVersion)
+	binary.BigEndian.PutUint16(header[10:], flags)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &DumpWriter{
+		writer:  w,
+		indexed: indexed,
+		index:   make(map[string]*DumpIndexEntry),
+	}, nil
+}
+
+func (d *DumpWriter) Write(msg *Message) error {
+	raw := msg.GetRawMessage()
+	if len(raw) == 0 {
+		return ErrDumpEmptyMessage
+	}
+
+	frameHeader := make([]byte, dumpFrameHeaderLength)
+	binary.BigEndian.PutUint32(frameHeader, uint32(len(raw)))
+	binary.BigEndian.PutUint32(frameHeader[4:], crc32.ChecksumIEEE(raw))
+	if _, err := d.writer.Write(frameHeader); err != nil {
+		return err
+	}
+	if _, err := d.writer.Write(raw); err != nil {
+		return err
+	}
+
+	if d.indexed {
+		d.addToIndex(msg.GetLogMessage())
+	}
+	return nil
+}
+
+// Close writes the end marker and, for indexed dumps, the index. It does not
+// close the underlying writer.
+func (d *DumpWriter) Close() error {
+	if _, err := d.writer.Write(make([]byte, 4)); err != nil {
+		return err
+	}
+	if !d.indexed {
+		return nil
+	}
+
+	indexBytes := d.buildIndex().encode()
+	footer := make([]byte, dumpIndexFooterLength)
+	binary.BigEndian.PutUint32(footer, uint32(len(indexBytes)))
+	binary.BigEndian.PutUint32(footer[4:], crc32.ChecksumIEEE(indexBytes))
+	copy(footer[8:], dumpIndexMagic)
+
+	if _, err := d.writer.Write(indexBytes); err != nil {
+		return err
+	}
+	_, err := d.writer.Write(footer)
+	return err
+}
+
+func (d *DumpWriter) addToIndex(logMessage *LogMessage) {
+	appId := logMessage.GetAppId()
+	timestamp := logMessage.GetTimestamp()
+
+	entry, ok := d.index[appId]
+	if !ok {
+		d.index[appId] = &DumpIndexEntry{
+			AppId:          appId,
+			MessageCount:   1,
+			FirstTimestamp: timestamp,
+			LastTimestamp:  timestamp,
+		}
+		return
+	}
+
+	entry.MessageCount++
+	if timestamp < entry.FirstTimestamp {
+		entry.FirstTimestamp = timestamp
+	}
+	if timestamp > entry.LastTimestamp {
+		entry.LastTimestamp = timestamp
+	}
+}
+
+func (d *DumpWriter) buildIndex() *DumpIndex {
+	index := &DumpIndex{}
+	for _, entry := range d.index {
+		index.Entries = append(index.Entries, *entry)
+	}
+	sort.Sort(byAppId(index.Entries))
+	return index
+}
+
+type DumpIndex struct {
+	Entries []DumpIndexEntry
+}
+
+type DumpIndexEntry struct {
+	AppId          string
+	MessageCount   uint32
+	FirstTimestamp int64
+	LastTimestamp  int64
+}
+
+type dumpIndexRecord struct {
+	MessageCount   uint32
+	FirstTimestamp int64
+	LastTimestamp  int64
+}
+
+func (i *DumpIndex) Find(appId string) (DumpIndexEntry, bool) {
+	n := sort.Search(len(i.Entries), func(n int) bool {
+		return i.Entries[n].AppId >= appId
+	})
+	if n < len(i.Entries) && i.Entries[n].AppId == appId {
+		return i.Entries[n], true
+	}
+	return DumpIndexEntry{}, false
+}
+
+func (e DumpIndexEntry) Overlaps(from, to time.Time) bool {
+	return e.FirstTimestamp <= to.UnixNano() && e.LastTimestamp >= from.UnixNano()
+}
+
+func (i *DumpIndex) encode() []byte {
+	buffer := &bytes.Buffer{}
+	binary.Write(buffer, binary.BigEndian, uint32(len(i.Entries)))
+	for _, entry := range i.Entries {
+		binary.Write(buffer, binary.BigEndian, uint16(len(entry.AppId)))
+		buffer.WriteString(entry.AppId)
+		binary.Write(buffer, binary.BigEndian, dumpIndexRecord{
+			MessageCount:   entry.MessageCount,
+			FirstTimestamp: entry.FirstTimestamp,
+			LastTimestamp:  entry.LastTimestamp,
+		})
+	}
+	return buffer.Bytes()
+}
+
+func decodeDumpIndex(b []byte) (*DumpIndex, error) {
+	reader := bytes.NewReader(b)
+
+	var count uint32
+	if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+		return nil, ErrDumpTruncated
+	}
+
+	index := &DumpIndex{}
+	for n := uint32(0); n < count; n++ {
+		var appIdLength uint16
+		if err := binary.Read(reader, binary.BigEndian, &appIdLength); err != nil {
+			return nil, ErrDumpTruncated
+		}
+		appId := make([]byte, appIdLength)
+		if _, err := io.ReadFull(reader, appId); err != nil {
+			return nil, ErrDumpTruncated
+		}
+		var record dumpIndexRecord
+		if err := binary.Read(reader, binary.BigEndian, &record); err != nil {
+			return nil, ErrDumpTruncated
+		}
+
+		index.Entries = append(index.Entries, DumpIndexEntry{
+			AppId:          string(appId),
+			MessageCount:   record.MessageCount,
+			FirstTimestamp: record.FirstTimestamp,
+			LastTimestamp:  record.LastTimestamp,
+		})
+	}
+	return index, nil
+}
+
+func IsVersionedDump(b []byte) bool {
+	return bytes.HasPrefix(b, dumpMagic)
+}
+
+// VerifyDump checks the header, every frame checksum and, if present, the
+// index checksum of a versioned dump without unmarshalling any message.
+func VerifyDump(b []byte) error {
+	flags, trailer, err := walkVersionedDump(b, func([]byte) error { return nil })
+	if err != nil {
+		return err
+	}
+
+	if flags&DumpFlagIndexed == 0 {
+		if len(trailer) != 0 {
+			return ErrDumpTrailingData
+		}
+		return nil
+	}
+
+	indexBytes, err := indexFromTrailer(trailer)
+	if err != nil {
+		return err
+	}
+	if len(indexBytes)+dumpIndexFooterLength != len(trailer) {
+		return ErrDumpTrailingData
+	}
+	_, err = decodeDumpIndex(indexBytes)
+	return err
+}
+
+// ReadDumpIndex reads the index from the end of a versioned dump without
+// walking its frames.
+func ReadDumpIndex(b []byte) (*DumpIndex, error) {
+	flags, err := readDumpHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if flags&DumpFlagIndexed == 0 {
+		return nil, ErrDumpNoIndex
+	}
+
+	indexBytes, err := indexFromTrailer(b[dumpHeaderLength:])
+	if err != nil {
+		return nil, err
+	}
+	return decodeDumpIndex(indexBytes)
+}
+
+func readDumpHeader(b []byte) (flags uint16, err error) {
+	if len(b) < dumpHeaderLength || !IsVersionedDump(b) {
+		return 0, ErrDumpInvalidHeader
+	}
+	if binary.BigEndian.Uint16(b[8:]) != DumpFormatVersion {
+		return 0, ErrDumpUnsupportedVersion
+	}
+	return binary.BigEndian.Uint16(b[10:]), nil
+}
+
+func indexFromTrailer(trailer []byte) ([]byte, error) {
+	if len(trailer) < dumpIndexFooterLength {
+		return nil, ErrDumpTruncated
+	}
+
+	footer := trailer[len(trailer)-dumpIndexFooterLength:]
+	if !bytes.Equal(footer[8:], dumpIndexMagic) {
+		return nil, ErrDumpTruncated
+	}
+
+	length := int(binary.BigEndian.Uint32(footer))
+	if length > len(trailer)-dumpIndexFooterLength {
+		return nil, ErrDumpTruncated
+	}
+
+	indexBytes := trailer[len(trailer)-dumpIndexFooterLength-length : len(trailer)-dumpIndexFooterLength]
+	if crc32.ChecksumIEEE(indexBytes) != binary.BigEndian.Uint32(footer[4:]) {
+		return nil, ErrDumpChecksumMismatch
+	}
+	return indexBytes, nil
+}
+
+// walkVersionedDump calls visit with every checksum-verified frame and returns
+// the bytes following the end marker.
+func walkVersionedDump(b []byte, visit func(frame []byte) error) (flags uint16, trailer []byte, err error) {
+	flags, err = readDumpHeader(b)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	offset := dumpHeaderLength
+	for {
+		if len(b)-offset < 4 {
+			return flags, nil, ErrDumpTruncated
+		}
+
+		length := int(binary.BigEndian.Uint32(b[offset:]))
+		if length == 0 {
+			return flags, b[offset+4:], nil
+		}
+		if len(b)-offset-dumpFrameHeaderLength < length {
+			return flags, nil, ErrDumpTruncated
+		}
+
+		checksum := binary.BigEndian.Uint32(b[offset+4:])
+		frame := b[offset+dumpFrameHeaderLength : offset+dumpFrameHeaderLength+length]
+		if crc32.ChecksumIEEE(frame) != checksum {
+			return flags, nil, ErrDumpChecksumMismatch
+		}
+
+		if err = visit(frame); err != nil {
+			return flags, nil, err
+		}
+		offset += dumpFrameHeaderLength + length
+	}
+}
+
+func parseVersionedDump(b []byte) (messages []*LogMessage, err error) {
+	_, _, err = walkVersionedDump(b, func(frame []byte) error {
+		msg, err := parseLogMessage(frame)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, msg)
+		return nil
+	})
+	return
+}
+
+type byAppId []DumpIndexEntry
+
+func (s byAppId) Len() int           { return len(s) }
+func (s byAppId) Less(i, j int) bool { return s[i].AppId < s[j].AppId }
+func (s byAppId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
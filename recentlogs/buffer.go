@@ -0,0 +1,190 @@
+package recentlogs
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+const (
+	defaultMessagesPerApp = 100
+	defaultMaxBytes       = 64 * 1024 * 1024
+)
+
+type Config struct {
+	MessagesPerApp int
+	MaxBytes       int
+}
+
+func (c Config) withDefaults() Config {
+	if c.MessagesPerApp <= 0 {
+		c.MessagesPerApp = defaultMessagesPerApp
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultMaxBytes
+	}
+	return c
+}
+
+// Buffer keeps the most recent messages of every app. Once the raw messages
+// of all apps exceed MaxBytes, the apps that were least recently written or
+// read are evicted as a whole.
+type Buffer struct {
+	config Config
+
+	sync.Mutex
+	apps     map[string]*list.Element
+	lru      *list.List
+	sizes    map[string]int
+	numBytes int
+}
+
+type appRing struct {
+	appId    string
+	messages []*logmessage.Message
+	start    int
+	count    int
+	numBytes int
+}
+
+func NewBuffer(config Config) *Buffer {
+	return &Buffer{
+		config: config.withDefaults(),
+		apps:   make(map[string]*list.Element),
+		lru:    list.New(),
+		sizes:  make(map[string]int),
+	}
+}
+
+// SetAppSize overrides the number of messages kept for an app. A size of
+// zero or less restores the default.
+func (b *Buffer) SetAppSize(appId string, size int) {
+	b.Lock()
+	defer b.Unlock()
+
+	if size <= 0 {
+		delete(b.sizes, appId)
+		size = b.config.MessagesPerApp
+	} else {
+		b.sizes[appId] = size
+	}
+
+	if element, ok := b.apps[appId]; ok {
+		b.resize(element.Value.(*appRing), size)
+	}
+}
+
+func (b *Buffer) Add(message *logmessage.Message) {
+	appId := message.GetLogMessage().GetAppId()
+	if appId == "" {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	element, ok := b.apps[appId]
+	if !ok {
+		element = b.lru.PushFront(&appRing{appId: appId, messages: make([]*logmessage.Message, b.sizeFor(appId))})
+		b.apps[appId] = element
+	}
+	b.lru.MoveToFront(element)
+
+	ring := element.Value.(*appRing)
+	if ring.count == len(ring.messages) {
+		b.dropOldest(ring)
+	}
+	ring.messages[(ring.start+ring.count)%len(ring.messages)] = message
+	ring.count++
+	ring.numBytes += int(message.GetRawMessageLength())
+	b.numBytes += int(message.GetRawMessageLength())
+
+	b.evict(ring)
+}
+
+// Recent returns the buffered messages of an app, oldest first.
+func (b *Buffer) Recent(appId string) []*logmessage.Message {
+	b.Lock()
+	defer b.Unlock()
+
+	element, ok := b.apps[appId]
+	if !ok {
+		return nil
+	}
+	b.lru.MoveToFront(element)
+
+	ring := element.Value.(*appRing)
+	messages := make([]*logmessage.Message, ring.count)
+	for i := range messages {
+		messages[i] = ring.messages[(ring.start+i)%len(ring.messages)]
+	}
+	return messages
+}
+
+func (b *Buffer) Remove(appId string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if element, ok := b.apps[appId]; ok {
+		b.removeElement(element)
+	}
+}
+
+// Usage reports how many apps are buffered and the size of their raw messages.
+func (b *Buffer) Usage() (apps int, numBytes int) {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.apps), b.numBytes
+}
+
+func (b *Buffer) sizeFor(appId string) int {
+	if size, ok := b.sizes[appId]; ok {
+		return size
+	}
+	return b.config.MessagesPerApp
+}
+
+func (b *Buffer) resize(ring *appRing, size int) {
+	for ring.count > size {
+		b.dropOldest(ring)
+	}
+
+	messages := make([]*logmessage.Message, size)
+	for i := 0; i < ring.count; i++ {
+		messages[i] = ring.messages[(ring.start+i)%len(ring.messages)]
+	}
+	ring.messages = messages
+	ring.start = 0
+}
+
+func (b *Buffer) dropOldest(ring *appRing) {
+	oldest := ring.messages[ring.start]
+	ring.messages[ring.start] = nil
+	ring.start = (ring.start + 1) % len(ring.messages)
+	ring.count--
+	ring.numBytes -= int(oldest.GetRawMessageLength())
+	b.numBytes -= int(oldest.GetRawMessageLength())
+}
+
+// evict removes the least recently used apps until the buffer fits. The app
+// that was just written is never evicted; it gives up its oldest messages
+// instead when it alone exceeds the limit.
+func (b *Buffer) evict(current *appRing) {
+	for b.numBytes > b.config.MaxBytes {
+		oldest := b.lru.Back()
+		if oldest.Value.(*appRing) == current {
+			break
+		}
+		b.removeElement(oldest)
+	}
+	for b.numBytes > b.config.MaxBytes && current.count > 1 {
+		b.dropOldest(current)
+	}
+}
+
+func (b *Buffer) removeElement(element *list.Element) {
+	ring := b.lru.Remove(element).(*appRing)
+	delete(b.apps, ring.appId)
+	b.numBytes -= ring.numBytes
+}
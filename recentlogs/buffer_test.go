@@ -0,0 +1,117 @@
+package recentlogs_test
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+	"github.com/cloudfoundry/loggregatorlib/recentlogs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Buffer", func() {
+	newMessage := func(text, appId string) *logmessage.Message {
+		message, err := testhelpers.NewMessageWithError(text, appId)
+		Expect(err).NotTo(HaveOccurred())
+		return message
+	}
+
+	texts := func(messages []*logmessage.Message) []string {
+		var result []string
+		for _, message := range messages {
+			result = append(result, string(message.GetLogMessage().GetMessage()))
+		}
+		return result
+	}
+
+	fill := func(buffer *recentlogs.Buffer, appId string, count int) {
+		for i := 0; i < count; i++ {
+			buffer.Add(newMessage(fmt.Sprintf("message %d", i), appId))
+		}
+	}
+
+	It("keeps the most recent messages per app, oldest first", func() {
+		buffer := recentlogs.NewBuffer(recentlogs.Config{MessagesPerApp: 3})
+		fill(buffer, "app-1", 5)
+		buffer.Add(newMessage("other", "app-2"))
+
+		Expect(texts(buffer.Recent("app-1"))).To(Equal([]string{"message 2", "message 3", "message 4"}))
+		Expect(texts(buffer.Recent("app-2"))).To(Equal([]string{"other"}))
+		Expect(buffer.Recent("unknown")).To(BeEmpty())
+	})
+
+	It("ignores messages without an app id", func() {
+		buffer := recentlogs.NewBuffer(recentlogs.Config{})
+		buffer.Add(newMessage("no app", ""))
+
+		apps, _ := buffer.Usage()
+		Expect(apps).To(BeZero())
+	})
+
+	It("resizes individual apps", func() {
+		buffer := recentlogs.NewBuffer(recentlogs.Config{MessagesPerApp: 3})
+		buffer.SetAppSize("app-1", 5)
+		fill(buffer, "app-1", 6)
+		fill(buffer, "app-2", 6)
+
+		Expect(buffer.Recent("app-1")).To(HaveLen(5))
+		Expect(buffer.Recent("app-2")).To(HaveLen(3))
+
+		buffer.SetAppSize("app-1", 2)
+		Expect(texts(buffer.Recent("app-1"))).To(Equal([]string{"message 4", "message 5"}))
+
+		buffer.SetAppSize("app-1", 0)
+		fill(buffer, "app-1", 6)
+		Expect(buffer.Recent("app-1")).To(HaveLen(3))
+	})
+
+	It("tracks memory and releases it when apps are removed", func() {
+		buffer := recentlogs.NewBuffer(recentlogs.Config{MessagesPerApp: 2})
+		message := newMessage("message", "app-1")
+		buffer.Add(message)
+		buffer.Add(message)
+		buffer.Add(message)
+
+		apps, numBytes := buffer.Usage()
+		Expect(apps).To(Equal(1))
+		Expect(numBytes).To(Equal(2 * int(message.GetRawMessageLength())))
+
+		buffer.Remove("app-1")
+		apps, numBytes = buffer.Usage()
+		Expect(apps).To(BeZero())
+		Expect(numBytes).To(BeZero())
+	})
+
+	Context("when the memory limit is reached", func() {
+		var buffer *recentlogs.Buffer
+		var messageSize int
+
+		BeforeEach(func() {
+			messageSize = int(newMessage("message 0", "app-1").GetRawMessageLength())
+			buffer = recentlogs.NewBuffer(recentlogs.Config{MessagesPerApp: 10, MaxBytes: 5 * messageSize})
+		})
+
+		It("evicts the least recently used apps", func() {
+			fill(buffer, "app-1", 2)
+			fill(buffer, "app-2", 2)
+			buffer.Recent("app-1")
+			fill(buffer, "app-3", 2)
+
+			Expect(buffer.Recent("app-1")).To(HaveLen(2))
+			Expect(buffer.Recent("app-2")).To(BeEmpty())
+			Expect(buffer.Recent("app-3")).To(HaveLen(2))
+
+			apps, numBytes := buffer.Usage()
+			Expect(apps).To(Equal(2))
+			Expect(numBytes).To(BeNumerically("<=", 5*messageSize))
+		})
+
+		It("trims an app that exceeds the limit on its own", func() {
+			fill(buffer, "app-1", 8)
+
+			Expect(texts(buffer.Recent("app-1"))).To(Equal([]string{"message 3", "message 4", "message 5", "message 6", "message 7"}))
+		})
+	})
+})
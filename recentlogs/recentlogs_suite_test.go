@@ -0,0 +1,13 @@
+package recentlogs_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestRecentlogs(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Recentlogs Suite")
+}
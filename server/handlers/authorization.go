@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cloudfoundry/loggregatorlib/appid"
+)
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// Authorizer decides whether a request may stream the logs of an app. Returning
+// ErrUnauthorized answers 401, any other error answers 403.
+type Authorizer interface {
+	Authorize(r *http.Request, appId string) error
+}
+
+type AuthorizerFunc func(r *http.Request, appId string) error
+
+func (f AuthorizerFunc) Authorize(r *http.Request, appId string) error {
+	return f(r, appId)
+}
+
+// authorize writes an error response and returns false if the request is
+// denied. A nil Authorizer allows everything.
+func authorize(authorizer Authorizer, rw http.ResponseWriter, r *http.Request) bool {
+	if authorizer == nil {
+		return true
+	}
+
+	err := authorizer.Authorize(r, appid.FromUrl(r.URL))
+	switch err {
+	case nil:
+		return true
+	case ErrUnauthorized:
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	default:
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	}
+	return false
+}
+
+// originChecker allows requests without an Origin header (non-browser
+// clients) and those whose origin is listed. An empty list or "*" allows any
+// origin.
+func originChecker(allowedOrigins []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		if len(allowedOrigins) == 0 {
+			return true
+		}
+
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || strings.EqualFold(strings.TrimRight(allowed, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
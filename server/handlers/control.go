@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync"
+)
+
+// Clients may steer a websocket stream by sending text frames holding a JSON
+// ControlMessage. Each one is answered with a text frame holding a
+// ControlResponse; binary frames remain reserved for log messages. Text frames
+// that are not JSON objects are ignored, so old style keep alives keep working.
+const (
+	ControlPause  = "pause"
+	ControlResume = "resume"
+	ControlFilter = "filter"
+	ControlReplay = "replay"
+
+	ControlResponseAck   = "ack"
+	ControlResponseError = "error"
+)
+
+type ControlMessage struct {
+	Type  string `json:"type"`
+	Query string `json:"query,omitempty"`
+	Count int    `json:"count,omitempty"`
+}
+
+type ControlResponse struct {
+	Type   string `json:"type"`
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func parseControlMessage(data []byte) (ControlMessage, bool) {
+	var control ControlMessage
+	if err := json.Unmarshal(data, &control); err != nil || control.Type == "" {
+		return ControlMessage{}, false
+	}
+	return control, true
+}
+
+func (c ControlMessage) filter() (*Filter, error) {
+	query, err := url.ParseQuery(c.Query)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFilter(query)
+}
+
+// messageHistory remembers the most recent messages of a connection, before
+// filtering, so that they can be replayed on request.
+type messageHistory struct {
+	sync.Mutex
+	messages [][]byte
+	next     int
+	full     bool
+}
+
+func newMessageHistory(size int) *messageHistory {
+	return &messageHistory{messages: make([][]byte, size)}
+}
+
+func (h *messageHistory) add(message []byte) {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.messages) == 0 {
+		return
+	}
+	h.messages[h.next] = message
+	h.next = (h.next + 1) % len(h.messages)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// last returns up to count of the most recent messages that pass the filter,
+// oldest first.
+func (h *messageHistory) last(count int, filter *Filter) [][]byte {
+	h.Lock()
+	defer h.Unlock()
+
+	size := h.next
+	if h.full {
+		size = len(h.messages)
+	}
+
+	var result [][]byte
+	for i := 1; i <= size && len(result) < count; i++ {
+		message := h.messages[(h.next-i+len(h.messages))%len(h.messages)]
+		if filter.Allows(message) {
+			result = append(result, message)
+		}
+	}
+
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
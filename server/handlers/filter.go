@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+// Filter selects log messages by the query parameters type (OUT or ERR),
+// source_name, source_id, contains, regex, start and end. Times are either
+// RFC 3339 or unix nanoseconds.
+type Filter struct {
+	MessageType *logmessage.LogMessage_MessageType
+	SourceName  string
+	SourceId    string
+	Contains    []byte
+	Pattern     *regexp.Regexp
+	Start       time.Time
+	End         time.Time
+}
+
+func ParseFilter(query url.Values) (*Filter, error) {
+	f := &Filter{
+		SourceName: query.Get("source_name"),
+		SourceId:   query.Get("source_id"),
+		Contains:   []byte(query.Get("contains")),
+	}
+
+	if messageType := query.Get("type"); messageType != "" {
+		value, ok := logmessage.LogMessage_MessageType_value[messageType]
+		if !ok {
+			return nil, fmt.Errorf("invalid message type %q", messageType)
+		}
+		f.MessageType = logmessage.LogMessage_MessageType(value).Enum()
+	}
+
+	if pattern := query.Get("regex"); pattern != "" {
+		var err error
+		f.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %s", err)
+		}
+	}
+
+	var err error
+	if f.Start, err = parseFilterTime(query.Get("start")); err != nil {
+		return nil, err
+	}
+	if f.End, err = parseFilterTime(query.Get("end")); err != nil {
+		return nil, err
+	}
+	if !f.Start.IsZero() && !f.End.IsZero() && f.End.Before(f.Start) {
+		return nil, fmt.Errorf("end is before start")
+	}
+
+	return f, nil
+}
+
+func (f *Filter) IsEmpty() bool {
+	return f == nil || (f.MessageType == nil && f.SourceName == "" && f.SourceId == "" &&
+		len(f.Contains) == 0 && f.Pattern == nil && f.Start.IsZero() && f.End.IsZero())
+}
+
+func (f *Filter) Match(logMessage *logmessage.LogMessage) bool {
+	if f.IsEmpty() {
+		return true
+	}
+
+	if f.MessageType != nil && logMessage.GetMessageType() != *f.MessageType {
+		return false
+	}
+	if f.SourceName != "" && logMessage.GetSourceName() != f.SourceName {
+		return false
+	}
+	if f.SourceId != "" && logMessage.GetSourceId() != f.SourceId {
+		return false
+	}
+	if len(f.Contains) > 0 && !bytes.Contains(logMessage.GetMessage(), f.Contains) {
+		return false
+	}
+	if f.Pattern != nil && !f.Pattern.Match(logMessage.GetMessage()) {
+		return false
+	}
+
+	timestamp := logMessage.GetTimestamp()
+	if !f.Start.IsZero() && timestamp < f.Start.UnixNano() {
+		return false
+	}
+	if !f.End.IsZero() && timestamp > f.End.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// Allows reports whether a marshalled LogMessage passes the filter. Messages
+// are only unmarshalled when the filter is not empty; anything that is not a
+// LogMessage is rejected by a non-empty filter.
+func (f *Filter) Allows(message []byte) bool {
+	if f.IsEmpty() {
+		return true
+	}
+
+	parsed, err := logmessage.ParseMessage(message)
+	if err != nil {
+		return false
+	}
+	return f.Match(parsed.GetLogMessage())
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if nanos, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, nanos), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	return t, nil
+}
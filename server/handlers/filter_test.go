@@ -0,0 +1,79 @@
+package handlers_test
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+	. "github.com/cloudfoundry/loggregatorlib/server/handlers"
+	"github.com/gogo/protobuf/proto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filter", func() {
+	var logMessage *logmessage.LogMessage
+
+	parse := func(query string) *Filter {
+		values, err := url.ParseQuery(query)
+		Expect(err).NotTo(HaveOccurred())
+		filter, err := ParseFilter(values)
+		Expect(err).NotTo(HaveOccurred())
+		return filter
+	}
+
+	BeforeEach(func() {
+		logMessage = testhelpers.NewLogMessage("GET /health 200", "app-1")
+		logMessage.SourceId = proto.String("1")
+		logMessage.Timestamp = proto.Int64(time.Date(2014, 5, 13, 12, 0, 0, 0, time.UTC).UnixNano())
+	})
+
+	It("is empty without filter parameters", func() {
+		filter := parse("app=app-1")
+		Expect(filter.IsEmpty()).To(BeTrue())
+		Expect(filter.Allows([]byte("anything"))).To(BeTrue())
+	})
+
+	It("filters by message type", func() {
+		Expect(parse("type=OUT").Match(logMessage)).To(BeTrue())
+		Expect(parse("type=ERR").Match(logMessage)).To(BeFalse())
+	})
+
+	It("filters by source name and id", func() {
+		Expect(parse("source_name=App&source_id=1").Match(logMessage)).To(BeTrue())
+		Expect(parse("source_name=RTR").Match(logMessage)).To(BeFalse())
+		Expect(parse("source_id=2").Match(logMessage)).To(BeFalse())
+	})
+
+	It("filters by substring and regex on the message body", func() {
+		Expect(parse("contains=health").Match(logMessage)).To(BeTrue())
+		Expect(parse("contains=metrics").Match(logMessage)).To(BeFalse())
+		Expect(parse("regex=" + url.QueryEscape(` [2-3]\d\d$`)).Match(logMessage)).To(BeTrue())
+		Expect(parse("regex=" + url.QueryEscape(` 5\d\d$`)).Match(logMessage)).To(BeFalse())
+	})
+
+	It("filters by time range", func() {
+		Expect(parse("start=2014-05-13T11:00:00Z&end=2014-05-13T13:00:00Z").Match(logMessage)).To(BeTrue())
+		Expect(parse("start=2014-05-13T12:00:01Z").Match(logMessage)).To(BeFalse())
+		Expect(parse("end=1399000000000000000").Match(logMessage)).To(BeFalse())
+	})
+
+	It("rejects anything that is not a LogMessage once it filters", func() {
+		Expect(parse("type=OUT").Allows([]byte("not a log message"))).To(BeFalse())
+
+		data, err := proto.Marshal(logMessage)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parse("type=OUT").Allows(data)).To(BeTrue())
+	})
+
+	It("returns errors for invalid parameters", func() {
+		for _, query := range []string{"type=DEBUG", "regex=%28", "start=yesterday", "start=2014-05-13T13:00:00Z&end=2014-05-13T12:00:00Z"} {
+			values, err := url.ParseQuery(query)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ParseFilter(values)
+			Expect(err).To(HaveOccurred(), query)
+		}
+	})
+})
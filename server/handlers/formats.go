@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+const (
+	contentTypeMultipartProtobuf = "multipart/x-protobuf"
+	contentTypeNDJSON            = "application/x-ndjson"
+	contentTypeEventStream       = "text/event-stream"
+	contentTypeText              = "text/plain"
+)
+
+var contentTypeAliases = map[string]string{
+	contentTypeMultipartProtobuf: contentTypeMultipartProtobuf,
+	contentTypeNDJSON:            contentTypeNDJSON,
+	"application/ndjson":         contentTypeNDJSON,
+	contentTypeEventStream:       contentTypeEventStream,
+	contentTypeText:              contentTypeText,
+}
+
+type messageWriter interface {
+	Write(message []byte) error
+	Close() error
+}
+
+type acceptedType struct {
+	mediaType string
+	quality   float64
+}
+
+// negotiateContentType picks the supported format the client prefers most,
+// falling back to multipart protobuf.
+func negotiateContentType(accept string) string {
+	var accepted []acceptedType
+	for _, entry := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality > 0 {
+			accepted = append(accepted, acceptedType{mediaType: mediaType, quality: quality})
+		}
+	}
+
+	sort.Stable(byQuality(accepted))
+	for _, a := range accepted {
+		if contentType, ok := contentTypeAliases[a.mediaType]; ok {
+			return contentType
+		}
+	}
+	return contentTypeMultipartProtobuf
+}
+
+func newMessageWriter(contentType string, rw http.ResponseWriter) messageWriter {
+	switch contentType {
+	case contentTypeNDJSON:
+		rw.Header().Set("Content-Type", contentTypeNDJSON)
+		return &ndjsonMessageWriter{rw: rw, encoder: logmessage.NewNDJSONEncoder(rw)}
+	case contentTypeEventStream:
+		rw.Header().Set("Content-Type", contentTypeEventStream)
+		rw.Header().Set("Cache-Control", "no-cache")
+		return &eventStreamMessageWriter{rw: rw}
+	case contentTypeText:
+		rw.Header().Set("Content-Type", contentTypeText+"; charset=utf-8")
+		return &textMessageWriter{rw: rw}
+	default:
+		mp := multipart.NewWriter(rw)
+		rw.Header().Set("Content-Type", contentTypeMultipartProtobuf+`; boundary=`+mp.Boundary())
+		return &multipartMessageWriter{mp: mp}
+	}
+}
+
+type multipartMessageWriter struct {
+	mp *multipart.Writer
+}
+
+func (w *multipartMessageWriter) Write(message []byte) error {
+	partWriter, err := w.mp.CreatePart(nil)
+	if err != nil {
+		return err
+	}
+
+	partWriter.Write(message)
+	return nil
+}
+
+func (w *multipartMessageWriter) Close() error {
+	return w.mp.Close()
+}
+
+type ndjsonMessageWriter struct {
+	rw      http.ResponseWriter
+	encoder *logmessage.NDJSONEncoder
+}
+
+func (w *ndjsonMessageWriter) Write(message []byte) error {
+	logMessage, ok := decodeLogMessage(message)
+	if !ok {
+		return nil
+	}
+
+	if err := w.encoder.Encode(logMessage); err != nil {
+		return err
+	}
+	flush(w.rw)
+	return nil
+}
+
+func (w *ndjsonMessageWriter) Close() error {
+	return nil
+}
+
+type eventStreamMessageWriter struct {
+	rw http.ResponseWriter
+}
+
+func (w *eventStreamMessageWriter) Write(message []byte) error {
+	logMessage, ok := decodeLogMessage(message)
+	if !ok {
+		return nil
+	}
+
+	data, err := logmessage.MarshalLogMessageJSON(logMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w.rw, "data: %s\n\n", data); err != nil {
+		return err
+	}
+	flush(w.rw)
+	return nil
+}
+
+func (w *eventStreamMessageWriter) Close() error {
+	return nil
+}
+
+type textMessageWriter struct {
+	rw http.ResponseWriter
+}
+
+func (w *textMessageWriter) Write(message []byte) error {
+	logMessage, ok := decodeLogMessage(message)
+	if !ok {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w.rw, "%s [%s/%s] %s %s\n",
+		time.Unix(0, logMessage.GetTimestamp()).UTC().Format(time.RFC3339Nano),
+		logMessage.GetSourceName(),
+		logMessage.GetSourceId(),
+		logMessage.GetMessageType(),
+		logMessage.GetMessage(),
+	)
+	if err != nil {
+		return err
+	}
+	flush(w.rw)
+	return nil
+}
+
+func (w *textMessageWriter) Close() error {
+	return nil
+}
+
+func decodeLogMessage(message []byte) (*logmessage.LogMessage, bool) {
+	parsed, err := logmessage.ParseMessage(message)
+	if err != nil {
+		log.Printf("http handler: Dropping message that is not a LogMessage: %s", err)
+		return nil, false
+	}
+	return parsed.GetLogMessage(), true
+}
+
+func flush(rw http.ResponseWriter) {
+	if flusher, ok := rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+type byQuality []acceptedType
+
+func (s byQuality) Len() int           { return len(s) }
+func (s byQuality) Less(i, j int) bool { return s[i].quality > s[j].quality }
+func (s byQuality) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
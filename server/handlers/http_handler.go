@@ -1,12 +1,14 @@
 package handlers
 
 import (
-	"mime/multipart"
 	"net/http"
+
+	"github.com/cloudfoundry/loggregatorlib/server"
 )
 
 type HttpHandler struct {
-	Messages <-chan []byte
+	Messages   <-chan []byte
+	Authorizer Authorizer
 }
 
 func NewHttpHandler(m <-chan []byte) *HttpHandler {
@@ -14,17 +16,52 @@ func NewHttpHandler(m <-chan []byte) *HttpHandler {
 }
 
 func (h *HttpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	mp := multipart.NewWriter(rw)
-	defer mp.Close()
+	if !authorize(h.Authorizer, rw, r) {
+		return
+	}
+
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	rw.Header().Set("Content-Type", `multipart/x-protobuf; boundary=`+mp.Boundary())
+	writer := newMessageWriter(negotiateContentType(r.Header.Get("Accept")), rw)
+	defer writer.Close()
 
-	for message := range h.Messages {
-		partWriter, err := mp.CreatePart(nil)
-		if err != nil {
+	for {
+		select {
+		case <-r.Context().Done():
+			if _, ok := server.ShutdownCause(r.Context()); ok {
+				h.flush(writer, filter)
+			}
 			return
+		case message, ok := <-h.Messages:
+			if !ok {
+				return
+			}
+			if !filter.Allows(message) {
+				continue
+			}
+			if err := writer.Write(message); err != nil {
+				return
+			}
 		}
+	}
+}
 
-		partWriter.Write(message)
+// flush writes the messages that are already waiting in the channel.
+func (h *HttpHandler) flush(writer messageWriter, filter *Filter) {
+	for pending := len(h.Messages); pending > 0; pending-- {
+		message, ok := <-h.Messages
+		if !ok {
+			return
+		}
+		if !filter.Allows(message) {
+			continue
+		}
+		if err := writer.Write(message); err != nil {
+			return
+		}
 	}
 }
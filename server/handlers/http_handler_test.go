@@ -1,13 +1,20 @@
 package handlers_test
 
 import (
+	"bufio"
+	"context"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+	"github.com/cloudfoundry/loggregatorlib/server"
 	"github.com/cloudfoundry/loggregatorlib/server/handlers"
+	"github.com/gogo/protobuf/proto"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -65,4 +72,163 @@ var _ = Describe("HttpHandler", func() {
 		handler.ServeHTTP(fakeResponseWriter, r)
 		Expect(fakeResponseWriter.Header().Get("Content-Type")).To(MatchRegexp(`multipart/x-protobuf; boundary=`))
 	})
+
+	Describe("content negotiation", func() {
+		var request *http.Request
+
+		BeforeEach(func() {
+			var err error
+			request, err = http.NewRequest("GET", "ws://loggregator.place/dump/?app=abc-123", nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			logMessage := testhelpers.NewLogMessage("hello", "abc-123")
+			logMessage.SourceId = proto.String("0")
+			data, err := proto.Marshal(logMessage)
+			Expect(err).NotTo(HaveOccurred())
+
+			messagesChan <- data
+			messagesChan <- []byte("not a log message")
+			close(messagesChan)
+		})
+
+		It("writes NDJSON", func() {
+			request.Header.Set("Accept", "application/x-ndjson")
+			handler.ServeHTTP(fakeResponseWriter, request)
+
+			Expect(fakeResponseWriter.Header().Get("Content-Type")).To(Equal("application/x-ndjson"))
+			message, err := logmessage.NewNDJSONDecoder(fakeResponseWriter.Body).Decode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message.GetLogMessage().GetMessage()).To(Equal([]byte("hello")))
+			Expect(fakeResponseWriter.Body.Len()).To(BeZero())
+		})
+
+		It("writes Server-Sent Events", func() {
+			request.Header.Set("Accept", "text/event-stream")
+			handler.ServeHTTP(fakeResponseWriter, request)
+
+			Expect(fakeResponseWriter.Header().Get("Content-Type")).To(Equal("text/event-stream"))
+			Expect(fakeResponseWriter.Flushed).To(BeTrue())
+
+			line, err := bufio.NewReader(fakeResponseWriter.Body).ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			Expect(line).To(HavePrefix("data: {"))
+			message, err := logmessage.ParseMessageJSON([]byte(strings.TrimPrefix(line, "data: ")))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message.GetLogMessage().GetAppId()).To(Equal("abc-123"))
+		})
+
+		It("writes plain text lines", func() {
+			request.Header.Set("Accept", "text/plain")
+			handler.ServeHTTP(fakeResponseWriter, request)
+
+			Expect(fakeResponseWriter.Header().Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+			Expect(fakeResponseWriter.Body.String()).To(MatchRegexp(`^\S+ \[App/0\] OUT hello\n$`))
+		})
+
+		It("honours quality values", func() {
+			request.Header.Set("Accept", "text/plain;q=0.5, application/x-ndjson")
+			handler.ServeHTTP(fakeResponseWriter, request)
+
+			Expect(fakeResponseWriter.Header().Get("Content-Type")).To(Equal("application/x-ndjson"))
+		})
+
+		It("falls back to multipart protobuf for unsupported types", func() {
+			request.Header.Set("Accept", "text/html, */*")
+			handler.ServeHTTP(fakeResponseWriter, request)
+
+			Expect(fakeResponseWriter.Header().Get("Content-Type")).To(MatchRegexp(`multipart/x-protobuf; boundary=`))
+		})
+	})
+
+	Describe("filtering", func() {
+		It("only writes messages matching the query filters", func() {
+			for _, text := range []string{"keep me", "drop me", "keep me too"} {
+				data, err := proto.Marshal(testhelpers.NewLogMessage(text, "abc-123"))
+				Expect(err).NotTo(HaveOccurred())
+				messagesChan <- data
+			}
+			close(messagesChan)
+
+			r, err := http.NewRequest("GET", "http://loggregator.place/dump/?app=abc-123&regex=%5Ekeep", nil)
+			Expect(err).NotTo(HaveOccurred())
+			r.Header.Set("Accept", "text/plain")
+			handler.ServeHTTP(fakeResponseWriter, r)
+
+			Expect(strings.Count(fakeResponseWriter.Body.String(), "\n")).To(Equal(2))
+			Expect(fakeResponseWriter.Body.String()).NotTo(ContainSubstring("drop me"))
+		})
+
+		It("responds with 400 for invalid filters", func() {
+			r, err := http.NewRequest("GET", "http://loggregator.place/dump/?app=abc-123&type=DEBUG", nil)
+			Expect(err).NotTo(HaveOccurred())
+			handler.ServeHTTP(fakeResponseWriter, r)
+
+			Expect(fakeResponseWriter.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	It("flushes waiting messages and ends the response on server shutdown", func() {
+		registry := server.NewRegistry(0)
+		r, err := http.NewRequest("GET", "http://loggregator.place/dump/?app=abc-123", nil)
+		Expect(err).NotTo(HaveOccurred())
+		r.Header.Set("Accept", "text/plain")
+
+		served := make(chan struct{})
+		go func() {
+			registry.Handler(handler).ServeHTTP(fakeResponseWriter, r)
+			close(served)
+		}()
+		Eventually(registry.Count).Should(Equal(1))
+
+		for i := 0; i < 3; i++ {
+			data, err := proto.Marshal(testhelpers.NewLogMessage("message", "abc-123"))
+			Expect(err).NotTo(HaveOccurred())
+			messagesChan <- data
+		}
+		Expect(registry.Shutdown(context.Background())).To(Succeed())
+
+		Eventually(served).Should(BeClosed())
+		Expect(strings.Count(fakeResponseWriter.Body.String(), "\n")).To(Equal(3))
+	})
+
+	Describe("authorization", func() {
+		BeforeEach(func() {
+			close(messagesChan)
+			handler = &handlers.HttpHandler{
+				Messages: messagesChan,
+				Authorizer: handlers.AuthorizerFunc(func(r *http.Request, appId string) error {
+					if appId != "abc-123" {
+						return handlers.ErrForbidden
+					}
+					if r.Header.Get("Authorization") == "" {
+						return handlers.ErrUnauthorized
+					}
+					return nil
+				}),
+			}
+		})
+
+		It("streams when the authorizer allows the request", func() {
+			r, _ := http.NewRequest("GET", "http://loggregator.place/dump/?app=abc-123", nil)
+			r.Header.Set("Authorization", "bearer token")
+			handler.ServeHTTP(fakeResponseWriter, r)
+
+			Expect(fakeResponseWriter.Code).To(Equal(http.StatusOK))
+		})
+
+		It("responds with 401 when the request is not authenticated", func() {
+			r, _ := http.NewRequest("GET", "http://loggregator.place/dump/?app=abc-123", nil)
+			handler.ServeHTTP(fakeResponseWriter, r)
+
+			Expect(fakeResponseWriter.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("responds with 403 when access to the app is denied", func() {
+			r, _ := http.NewRequest("GET", "http://loggregator.place/dump/?app=other-app", nil)
+			r.Header.Set("Authorization", "bearer token")
+			handler.ServeHTTP(fakeResponseWriter, r)
+
+			Expect(fakeResponseWriter.Code).To(Equal(http.StatusForbidden))
+		})
+	})
 })
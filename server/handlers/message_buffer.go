@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type SlowConsumerPolicy int
+
+const (
+	DropOldest SlowConsumerPolicy = iota
+	DropNewest
+	Disconnect
+)
+
+// messageBuffer decouples a connection from its producer so a slow client
+// never blocks the channel feeding the handler.
+type messageBuffer struct {
+	messages   chan []byte
+	policy     SlowConsumerPolicy
+	history    *messageHistory
+	dropped    uint64
+	overflowed chan struct{}
+	overflow   sync.Once
+
+	filterLock sync.RWMutex
+	filter     *Filter
+}
+
+func newMessageBuffer(size int, policy SlowConsumerPolicy, filter *Filter, historySize int) *messageBuffer {
+	return &messageBuffer{
+		messages:   make(chan []byte, size),
+		policy:     policy,
+		history:    newMessageHistory(historySize),
+		overflowed: make(chan struct{}),
+		filter:     filter,
+	}
+}
+
+// fill copies messages that pass the filter into the buffer until in is
+// closed or done fires, then closes the buffer. Messages already waiting in in
+// when done fires are still copied, so that they can be flushed.
+func (b *messageBuffer) fill(in <-chan []byte, done <-chan struct{}) {
+	defer close(b.messages)
+
+	for {
+		select {
+		case <-done:
+			for pending := len(in); pending > 0; pending-- {
+				message, ok := <-in
+				if !ok {
+					return
+				}
+				b.add(message)
+			}
+			return
+		case message, ok := <-in:
+			if !ok {
+				return
+			}
+			b.add(message)
+		}
+	}
+}
+
+func (b *messageBuffer) add(message []byte) {
+	b.history.add(message)
+	if b.Filter().Allows(message) {
+		b.push(message)
+	}
+}
+
+func (b *messageBuffer) push(message []byte) {
+	for {
+		select {
+		case b.messages <- message:
+			return
+		default:
+		}
+
+		switch b.policy {
+		case DropNewest:
+			atomic.AddUint64(&b.dropped, 1)
+			return
+		case Disconnect:
+			atomic.AddUint64(&b.dropped, 1)
+			b.overflow.Do(func() { close(b.overflowed) })
+			return
+		default:
+			select {
+			case <-b.messages:
+				atomic.AddUint64(&b.dropped, 1)
+			default:
+			}
+		}
+	}
+}
+
+func (b *messageBuffer) Filter() *Filter {
+	b.filterLock.RLock()
+	defer b.filterLock.RUnlock()
+	return b.filter
+}
+
+func (b *messageBuffer) SetFilter(filter *Filter) {
+	b.filterLock.Lock()
+	defer b.filterLock.Unlock()
+	b.filter = filter
+}
+
+func (b *messageBuffer) Replay(count int) [][]byte {
+	return b.history.last(count, b.Filter())
+}
+
+func (b *messageBuffer) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
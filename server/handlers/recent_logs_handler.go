@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/cloudfoundry/loggregatorlib/appid"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/recentlogs"
+)
+
+const contentTypeDump = "application/octet-stream"
+
+// RecentLogsHandler serves the buffered messages of the app named by the app
+// query parameter in the dump format, or as NDJSON when the client asks for it.
+type RecentLogsHandler struct {
+	Buffer     *recentlogs.Buffer
+	Authorizer Authorizer
+}
+
+func NewRecentLogsHandler(buffer *recentlogs.Buffer) *RecentLogsHandler {
+	return &RecentLogsHandler{Buffer: buffer}
+}
+
+func (h *RecentLogsHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !authorize(h.Authorizer, rw, r) {
+		return
+	}
+
+	appId := appid.FromUrl(r.URL)
+	if appId == "" {
+		http.Error(rw, "missing app parameter", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var messages []*logmessage.Message
+	for _, message := range h.Buffer.Recent(appId) {
+		if filter.Match(message.GetLogMessage()) {
+			messages = append(messages, message)
+		}
+	}
+
+	if negotiateContentType(r.Header.Get("Accept")) == contentTypeNDJSON {
+		rw.Header().Set("Content-Type", contentTypeNDJSON)
+		encoder := logmessage.NewNDJSONEncoder(rw)
+		for _, message := range messages {
+			if err := encoder.Encode(message.GetLogMessage()); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	var dump bytes.Buffer
+	for _, message := range messages {
+		logmessage.DumpMessage(*message, &dump)
+	}
+	rw.Header().Set("Content-Type", contentTypeDump)
+	rw.Write(dump.Bytes())
+}
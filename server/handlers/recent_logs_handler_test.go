@@ -0,0 +1,91 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+	"github.com/cloudfoundry/loggregatorlib/recentlogs"
+	"github.com/cloudfoundry/loggregatorlib/server/handlers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RecentLogsHandler", func() {
+	var buffer *recentlogs.Buffer
+	var handler *handlers.RecentLogsHandler
+	var recorder *httptest.ResponseRecorder
+
+	serve := func(url, accept string) {
+		r, err := http.NewRequest("GET", url, nil)
+		Expect(err).NotTo(HaveOccurred())
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		handler.ServeHTTP(recorder, r)
+	}
+
+	BeforeEach(func() {
+		buffer = recentlogs.NewBuffer(recentlogs.Config{})
+		handler = handlers.NewRecentLogsHandler(buffer)
+		recorder = httptest.NewRecorder()
+
+		for _, text := range []string{"first", "second", "GET /health"} {
+			message, err := testhelpers.NewMessageWithError(text, "abc-123")
+			Expect(err).NotTo(HaveOccurred())
+			buffer.Add(message)
+		}
+		message, err := testhelpers.NewMessageWithError("other app", "def-456")
+		Expect(err).NotTo(HaveOccurred())
+		buffer.Add(message)
+	})
+
+	It("serves the buffered messages of the app in the dump format", func() {
+		serve("http://loggregator.place/recent?app=abc-123", "")
+
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/octet-stream"))
+
+		messages, err := logmessage.ParseDumpedLogMessages(recorder.Body.Bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(messages).To(HaveLen(3))
+		Expect(string(messages[0].GetMessage())).To(Equal("first"))
+		Expect(string(messages[2].GetMessage())).To(Equal("GET /health"))
+	})
+
+	It("serves NDJSON when requested and applies filters", func() {
+		serve("http://loggregator.place/recent?app=abc-123&contains=health", "application/x-ndjson")
+
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/x-ndjson"))
+		lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+		Expect(lines).To(HaveLen(1))
+
+		message, err := logmessage.ParseMessageJSON([]byte(lines[0]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(message.GetLogMessage().GetMessage())).To(Equal("GET /health"))
+	})
+
+	It("serves an empty dump for unknown apps", func() {
+		serve("http://loggregator.place/recent?app=unknown", "")
+
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.Len()).To(BeZero())
+	})
+
+	It("requires an app", func() {
+		serve("http://loggregator.place/recent", "")
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("checks the authorizer", func() {
+		handler.Authorizer = handlers.AuthorizerFunc(func(r *http.Request, appId string) error {
+			return handlers.ErrUnauthorized
+		})
+
+		serve("http://loggregator.place/recent?app=abc-123", "")
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -1,26 +1,100 @@
 package handlers
 
 import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry/loggregatorlib/server"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	defaultWriteTimeout = 5 * time.Second
+	defaultBufferSize   = 100
+	defaultReplaySize   = 100
+	closeGracePeriod    = 500 * time.Millisecond
+)
+
+type WebsocketOptions struct {
+	WriteTimeout       time.Duration
+	BufferSize         int
+	SlowConsumerPolicy SlowConsumerPolicy
+	AllowedOrigins     []string
+	Authorizer         Authorizer
+
+	// KeepAlive tunes the pings sent to the client. Its PongTimeout defaults
+	// to the keepAlive passed to the constructor.
+	KeepAlive server.KeepAliveOptions
+
+	// ReplaySize is the number of recent messages kept per connection for
+	// clients that ask for a replay. A negative value disables replays.
+	ReplaySize int
+
+	// EnableCompression negotiates permessage-deflate with clients that offer
+	// it. Messages smaller than CompressionThreshold bytes are sent
+	// uncompressed. A CompressionLevel of 0 selects flate.BestSpeed.
+	EnableCompression    bool
+	CompressionLevel     int
+	CompressionThreshold int
+}
+
+func (o WebsocketOptions) withDefaults() WebsocketOptions {
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = defaultWriteTimeout
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultBufferSize
+	}
+	if o.ReplaySize == 0 {
+		o.ReplaySize = defaultReplaySize
+	} else if o.ReplaySize < 0 {
+		o.ReplaySize = 0
+	}
+	if o.CompressionLevel == 0 {
+		o.CompressionLevel = flate.BestSpeed
+	}
+	return o
+}
+
 type websocketHandler struct {
-	messages  <-chan []byte
-	keepAlive time.Duration
+	messages <-chan []byte
+	options  WebsocketOptions
 }
 
 func NewWebsocketHandler(m <-chan []byte, keepAlive time.Duration) *websocketHandler {
-	return &websocketHandler{messages: m, keepAlive: keepAlive}
+	return NewWebsocketHandlerWithOptions(m, keepAlive, WebsocketOptions{})
+}
+
+func NewWebsocketHandlerWithOptions(m <-chan []byte, keepAlive time.Duration, options WebsocketOptions) *websocketHandler {
+	if options.KeepAlive.PongTimeout <= 0 {
+		options.KeepAlive.PongTimeout = keepAlive
+	}
+	return &websocketHandler{messages: m, options: options.withDefaults()}
 }
 
 func (h *websocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(*http.Request) bool { return true },
+		CheckOrigin:       originChecker(h.options.AllowedOrigins),
+		EnableCompression: h.options.EnableCompression,
+	}
+	if !upgrader.CheckOrigin(r) {
+		http.Error(rw, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	if !authorize(h.options.Authorizer, rw, r) {
+		return
+	}
+
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	ws, err := upgrader.Upgrade(rw, r, nil)
@@ -28,50 +102,202 @@ func (h *websocketHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		log.Printf("websocket handler: Not a websocket handshake: %s", err)
 		return
 	}
-	defer ws.Close()
 
-	closeCode, closeMessage := h.runWebsocketUntilClosed(ws)
-	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeMessage), time.Now().Add(5*time.Second))
+	if h.options.EnableCompression {
+		if err := ws.SetCompressionLevel(h.options.CompressionLevel); err != nil {
+			log.Printf("websocket handler: Invalid compression level: %s", err)
+		}
+	}
+
+	h.runWebsocketUntilClosed(r.Context(), ws, filter)
 }
 
-func (h *websocketHandler) runWebsocketUntilClosed(ws *websocket.Conn) (closeCode int, closeMessage string) {
-	keepAliveExpired := make(chan struct{})
+// runWebsocketUntilClosed streams until the messages channel is closed, the
+// client goes away or ctx is done. It closes ws and returns only after all of
+// its goroutines have stopped.
+func (h *websocketHandler) runWebsocketUntilClosed(ctx context.Context, ws *websocket.Conn, filter *Filter) {
+	keepAliveStopped := make(chan server.StopReason, 1)
 	clientWentAway := make(chan struct{})
+	streamCtx, cancel := context.WithCancel(ctx)
+	done := streamCtx.Done()
 
-	// TODO: remove this loop (but keep ws.ReadMessage()) once we retire support in the cli for old style keep alives
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer ws.Close()
+	defer cancel()
+
+	controls := make(chan ControlMessage)
+	wg.Add(3)
 	go func() {
+		defer wg.Done()
 		for {
-			_, _, err := ws.ReadMessage()
+			messageType, data, err := ws.ReadMessage()
 			if err != nil {
 				close(clientWentAway)
 				return
 			}
+			if messageType != websocket.TextMessage {
+				continue
+			}
+			control, ok := parseControlMessage(data)
+			if !ok {
+				continue
+			}
+			select {
+			case controls <- control:
+			case <-done:
+			}
 		}
 	}()
 
 	go func() {
-		server.NewKeepAlive(ws, h.keepAlive).Run()
-		close(keepAliveExpired)
+		defer wg.Done()
+		keepAliveStopped <- server.NewKeepAliveWithOptions(ws, h.options.KeepAlive).RunContext(streamCtx)
+	}()
+
+	buffer := newMessageBuffer(h.options.BufferSize, h.options.SlowConsumerPolicy, filter, h.options.ReplaySize)
+	go func() {
+		defer wg.Done()
+		buffer.fill(h.messages, done)
 	}()
 
+	closeCode, closeMessage := h.stream(ctx, ws, buffer, controls, clientWentAway, keepAliveStopped)
+	ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeMessage), time.Now().Add(5*time.Second))
+
+	// Give the client a chance to answer the close frame; closing the socket
+	// while its replies are unread resets the connection and discards any
+	// frames the client has not read yet.
+	select {
+	case <-clientWentAway:
+	case <-time.After(closeGracePeriod):
+	}
+}
+
+func (h *websocketHandler) stream(ctx context.Context, ws *websocket.Conn, buffer *messageBuffer, controls <-chan ControlMessage, clientWentAway <-chan struct{}, keepAliveStopped <-chan server.StopReason) (closeCode int, closeMessage string) {
 	closeCode = websocket.CloseNormalClosure
 	closeMessage = ""
+	paused := false
 	for {
 		select {
+		case control := <-controls:
+			var err error
+			paused, err = h.handleControl(ws, buffer, control, paused)
+			if err != nil {
+				return
+			}
 		case <-clientWentAway:
 			return
-		case <-keepAliveExpired:
+		case <-ctx.Done():
+			return h.cancelledClose(ctx, ws, buffer, paused)
+		case reason := <-keepAliveStopped:
+			switch reason {
+			case server.PingFailed:
+				log.Printf("websocket handler: Could not ping the client, closing the stream")
+				return
+			case server.Cancelled:
+				return h.cancelledClose(ctx, ws, buffer, paused)
+			}
 			closeCode = websocket.ClosePolicyViolation
 			closeMessage = "Client did not respond to ping before keep-alive timeout expired."
 			return
-		case message, ok := <-h.messages:
+		case <-buffer.overflowed:
+			return slowConsumerClose(buffer)
+		case message, ok := <-buffer.messages:
 			if !ok {
+				if ctx.Err() != nil {
+					return h.cancelledClose(ctx, ws, buffer, paused)
+				}
+				if dropped := buffer.Dropped(); dropped > 0 {
+					closeMessage = fmt.Sprintf("%d messages dropped because the client was too slow.", dropped)
+				}
 				return
 			}
-			err := ws.WriteMessage(websocket.BinaryMessage, message)
-			if err != nil {
+			select {
+			case <-buffer.overflowed:
+				return slowConsumerClose(buffer)
+			default:
+			}
+
+			if paused {
+				continue
+			}
+			if err := h.writeMessage(ws, message); err != nil {
 				return
 			}
 		}
 	}
 }
+
+// handleControl applies a control message and answers it. Messages read while
+// paused are discarded but stay in the history, so a replay can recover them.
+func (h *websocketHandler) handleControl(ws *websocket.Conn, buffer *messageBuffer, control ControlMessage, paused bool) (bool, error) {
+	response := ControlResponse{Type: ControlResponseAck, Action: control.Type}
+	switch control.Type {
+	case ControlPause:
+		paused = true
+	case ControlResume:
+		paused = false
+	case ControlFilter:
+		filter, err := control.filter()
+		if err != nil {
+			response = ControlResponse{Type: ControlResponseError, Action: control.Type, Error: err.Error()}
+			break
+		}
+		buffer.SetFilter(filter)
+	case ControlReplay:
+		if control.Count <= 0 {
+			response = ControlResponse{Type: ControlResponseError, Action: control.Type, Error: "replay count must be positive"}
+			break
+		}
+		for _, message := range buffer.Replay(control.Count) {
+			if err := h.writeMessage(ws, message); err != nil {
+				return paused, err
+			}
+		}
+	default:
+		response = ControlResponse{Type: ControlResponseError, Action: control.Type, Error: "unknown control message"}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return paused, err
+	}
+	ws.EnableWriteCompression(false)
+	ws.SetWriteDeadline(time.Now().Add(h.options.WriteTimeout))
+	return paused, ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (h *websocketHandler) writeMessage(ws *websocket.Conn, message []byte) error {
+	if h.options.EnableCompression {
+		ws.EnableWriteCompression(len(message) >= h.options.CompressionThreshold)
+	}
+	ws.SetWriteDeadline(time.Now().Add(h.options.WriteTimeout))
+	return ws.WriteMessage(websocket.BinaryMessage, message)
+}
+
+// cancelledClose ends a stream whose context is done. On a server shutdown the
+// buffered messages are flushed first and the reason of the going away close
+// frame tells the client when to reconnect.
+func (h *websocketHandler) cancelledClose(ctx context.Context, ws *websocket.Conn, buffer *messageBuffer, paused bool) (int, string) {
+	shutdown, ok := server.ShutdownCause(ctx)
+	if !ok {
+		return websocket.CloseGoingAway, "The log stream was cancelled."
+	}
+
+	if !paused {
+		ws.SetWriteDeadline(time.Now().Add(h.options.WriteTimeout))
+		for message := range buffer.messages {
+			if h.options.EnableCompression {
+				ws.EnableWriteCompression(len(message) >= h.options.CompressionThreshold)
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, message); err != nil {
+				break
+			}
+		}
+	}
+	return websocket.CloseGoingAway, shutdown.Hint()
+}
+
+func slowConsumerClose(buffer *messageBuffer) (int, string) {
+	return websocket.CloseTryAgainLater, fmt.Sprintf("Client did not keep up with the log stream, %d messages dropped.", buffer.Dropped())
+}
@@ -1,11 +1,19 @@
 package handlers_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"time"
 
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+	"github.com/cloudfoundry/loggregatorlib/server"
 	"github.com/cloudfoundry/loggregatorlib/server/handlers"
+	"github.com/gogo/protobuf/proto"
 	"github.com/gorilla/websocket"
 
 	. "github.com/onsi/ginkgo"
@@ -143,6 +151,318 @@ var _ = Describe("WebsocketHandler", func() {
 		Eventually(handlerDone).Should(BeClosed())
 	})
 
+	It("only forwards messages matching the query filters", func() {
+		for _, messageType := range []string{"OUT", "ERR", "OUT"} {
+			logMessage := testhelpers.NewLogMessage(messageType, "abc-123")
+			if messageType == "ERR" {
+				logMessage.MessageType = logmessage.LogMessage_ERR.Enum()
+			}
+			data, err := proto.Marshal(logMessage)
+			Expect(err).NotTo(HaveOccurred())
+			messagesChan <- data
+		}
+		close(messagesChan)
+
+		ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL)+"?app=abc-123&type=ERR", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, msg, err := ws.ReadMessage()
+		Expect(err).NotTo(HaveOccurred())
+		receivedMessage := &logmessage.LogMessage{}
+		Expect(proto.Unmarshal(msg, receivedMessage)).To(Succeed())
+		Expect(receivedMessage.GetMessageType()).To(Equal(logmessage.LogMessage_ERR))
+
+		_, _, err = ws.ReadMessage()
+		Expect(err.Error()).To(ContainSubstring("websocket: close 1000"))
+		Eventually(handlerDone).Should(BeClosed())
+	})
+
+	It("rejects invalid filters before upgrading", func() {
+		_, resp, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL)+"?app=abc-123&regex=%28", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		Eventually(handlerDone).Should(BeClosed())
+	})
+
+	Context("when the client is too slow", func() {
+		const messageCount = 40
+		bigMessage := make([]byte, 1024*1024)
+
+		stallThenRead := func() (received int, closeErr error) {
+			ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			time.Sleep(300 * time.Millisecond)
+			for {
+				_, _, err := ws.ReadMessage()
+				if err != nil {
+					return received, err
+				}
+				received++
+			}
+		}
+
+		BeforeEach(func() {
+			messagesChan = make(chan []byte, messageCount)
+			for i := 0; i < messageCount; i++ {
+				messagesChan <- bigMessage
+			}
+		})
+
+		It("disconnects with a try again later close frame when the policy is Disconnect", func() {
+			handler = handlers.NewWebsocketHandlerWithOptions(messagesChan, time.Minute, handlers.WebsocketOptions{
+				BufferSize:         1,
+				SlowConsumerPolicy: handlers.Disconnect,
+			})
+
+			received, err := stallThenRead()
+			Expect(received).To(BeNumerically("<", messageCount))
+			Expect(err.Error()).To(ContainSubstring("websocket: close 1013"))
+			Expect(err.Error()).To(MatchRegexp(`\d+ messages dropped`))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("drops messages and reports the count when the stream ends", func() {
+			handler = handlers.NewWebsocketHandlerWithOptions(messagesChan, time.Minute, handlers.WebsocketOptions{
+				BufferSize:         1,
+				SlowConsumerPolicy: handlers.DropNewest,
+			})
+			close(messagesChan)
+
+			received, err := stallThenRead()
+			Expect(received).To(BeNumerically("<", messageCount))
+			Expect(err.Error()).To(ContainSubstring("websocket: close 1000"))
+			Expect(err.Error()).To(ContainSubstring(fmt.Sprintf("%d messages dropped", messageCount-received)))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("gives up on a stalled client once the write deadline passes", func() {
+			handler = handlers.NewWebsocketHandlerWithOptions(messagesChan, time.Minute, handlers.WebsocketOptions{
+				WriteTimeout: 100 * time.Millisecond,
+			})
+
+			ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+			defer ws.Close()
+
+			Eventually(handlerDone).Should(BeClosed())
+		})
+	})
+
+	Context("with allowed origins and an authorizer", func() {
+		var authorizedAppIds chan string
+
+		BeforeEach(func() {
+			authorizedAppIds = make(chan string, 1)
+			handler = handlers.NewWebsocketHandlerWithOptions(messagesChan, 100*time.Millisecond, handlers.WebsocketOptions{
+				AllowedOrigins: []string{"https://console.example.com"},
+				Authorizer: handlers.AuthorizerFunc(func(r *http.Request, appId string) error {
+					authorizedAppIds <- appId
+					switch r.Header.Get("Authorization") {
+					case "":
+						return handlers.ErrUnauthorized
+					case "bearer good-token":
+						return nil
+					default:
+						return handlers.ErrForbidden
+					}
+				}),
+			})
+		})
+
+		dial := func(origin, authorization string) (*websocket.Conn, *http.Response, error) {
+			header := http.Header{}
+			if origin != "" {
+				header.Set("Origin", origin)
+			}
+			if authorization != "" {
+				header.Set("Authorization", authorization)
+			}
+			return websocket.DefaultDialer.Dial(httpToWs(testServer.URL)+"?app=abc-123", header)
+		}
+
+		It("upgrades authorized requests from allowed origins", func() {
+			ws, _, err := dial("https://console.example.com", "bearer good-token")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(authorizedAppIds).To(Receive(Equal("abc-123")))
+
+			go ws.ReadMessage()
+			close(messagesChan)
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("upgrades authorized requests without an origin", func() {
+			ws, _, err := dial("", "bearer good-token")
+			Expect(err).NotTo(HaveOccurred())
+
+			go ws.ReadMessage()
+			close(messagesChan)
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("rejects other origins with 403 before authorizing", func() {
+			_, resp, err := dial("https://evil.example.com", "bearer good-token")
+			Expect(err).To(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(authorizedAppIds).To(BeEmpty())
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("responds with 401 when the authorizer returns ErrUnauthorized", func() {
+			_, resp, err := dial("https://console.example.com", "")
+			Expect(err).To(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("responds with 403 when the authorizer denies access", func() {
+			_, resp, err := dial("https://console.example.com", "bearer bad-token")
+			Expect(err).To(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+	})
+
+	Context("with compression enabled", func() {
+		BeforeEach(func() {
+			handler = handlers.NewWebsocketHandlerWithOptions(messagesChan, 100*time.Millisecond, handlers.WebsocketOptions{
+				EnableCompression:    true,
+				CompressionThreshold: 16,
+			})
+			messagesChan <- []byte("small")
+			messagesChan <- bytes.Repeat([]byte("a large and repetitive message "), 100)
+			close(messagesChan)
+		})
+
+		It("negotiates permessage-deflate with clients that support it", func() {
+			dialer := &websocket.Dialer{EnableCompression: true}
+			ws, resp, err := dialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Header.Get("Sec-Websocket-Extensions")).To(ContainSubstring("permessage-deflate"))
+
+			_, msg, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(msg)).To(Equal("small"))
+
+			_, msg, err = ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).To(Equal(bytes.Repeat([]byte("a large and repetitive message "), 100)))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("keeps working for clients without compression support", func() {
+			ws, resp, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Header.Get("Sec-Websocket-Extensions")).To(BeEmpty())
+
+			_, msg, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(msg)).To(Equal("small"))
+
+			_, msg, err = ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msg).To(HaveLen(3100))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+	})
+
+	Context("with control messages from the client", func() {
+		var ws *websocket.Conn
+
+		logMessage := func(messageType logmessage.LogMessage_MessageType, message string) []byte {
+			logMessage := testhelpers.NewLogMessage(message, "abc-123")
+			logMessage.MessageType = messageType.Enum()
+			data, err := proto.Marshal(logMessage)
+			Expect(err).NotTo(HaveOccurred())
+			return data
+		}
+
+		control := func(message string) handlers.ControlResponse {
+			Expect(ws.WriteMessage(websocket.TextMessage, []byte(message))).To(Succeed())
+
+			msgType, data, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msgType).To(Equal(websocket.TextMessage))
+			var response handlers.ControlResponse
+			Expect(json.Unmarshal(data, &response)).To(Succeed())
+			return response
+		}
+
+		readBinary := func() string {
+			msgType, data, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msgType).To(Equal(websocket.BinaryMessage))
+			return string(data)
+		}
+
+		BeforeEach(func() {
+			handler = handlers.NewWebsocketHandlerWithOptions(messagesChan, time.Minute, handlers.WebsocketOptions{})
+
+			var err error
+			ws, _, err = websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			close(messagesChan)
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("discards messages while paused", func() {
+			Expect(control(`{"type":"pause"}`)).To(Equal(handlers.ControlResponse{Type: "ack", Action: "pause"}))
+			messagesChan <- []byte("while paused")
+			time.Sleep(100 * time.Millisecond)
+
+			Expect(control(`{"type":"resume"}`)).To(Equal(handlers.ControlResponse{Type: "ack", Action: "resume"}))
+			messagesChan <- []byte("after resume")
+			Expect(readBinary()).To(Equal("after resume"))
+		})
+
+		It("replays the most recent messages before acknowledging", func() {
+			for _, message := range []string{"one", "two", "three"} {
+				messagesChan <- []byte(message)
+				Expect(readBinary()).To(Equal(message))
+			}
+
+			Expect(ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"replay","count":2}`))).To(Succeed())
+			Expect(readBinary()).To(Equal("two"))
+			Expect(readBinary()).To(Equal("three"))
+
+			_, data, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"type":"ack","action":"replay"}`))
+		})
+
+		It("changes the filter of a running stream", func() {
+			Expect(control(`{"type":"filter","query":"type=ERR"}`).Type).To(Equal(handlers.ControlResponseAck))
+
+			messagesChan <- logMessage(logmessage.LogMessage_OUT, "out")
+			messagesChan <- logMessage(logmessage.LogMessage_ERR, "err")
+
+			receivedMessage := &logmessage.LogMessage{}
+			Expect(proto.Unmarshal([]byte(readBinary()), receivedMessage)).To(Succeed())
+			Expect(string(receivedMessage.GetMessage())).To(Equal("err"))
+		})
+
+		It("answers invalid control messages with an error and keeps streaming", func() {
+			response := control(`{"type":"filter","query":"type=DEBUG"}`)
+			Expect(response.Type).To(Equal(handlers.ControlResponseError))
+			Expect(response.Error).NotTo(BeEmpty())
+
+			Expect(control(`{"type":"rewind"}`)).To(Equal(handlers.ControlResponse{Type: "error", Action: "rewind", Error: "unknown control message"}))
+			Expect(control(`{"type":"replay"}`).Type).To(Equal(handlers.ControlResponseError))
+
+			messagesChan <- []byte("still streaming")
+			Expect(readBinary()).To(Equal("still streaming"))
+		})
+
+		It("ignores text frames that are not control messages", func() {
+			Expect(ws.WriteMessage(websocket.TextMessage, []byte("I'm alive!"))).To(Succeed())
+			messagesChan <- []byte("message")
+			Expect(readBinary()).To(Equal("message"))
+		})
+	})
+
 	Context("when the KeepAlive expires", func() {
 		It("sends a CloseInternalServerErr frame", func() {
 			ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
@@ -165,6 +485,78 @@ var _ = Describe("WebsocketHandler", func() {
 		})
 	})
 
+	Context("when the request context is cancelled", func() {
+		var cancel context.CancelFunc
+
+		BeforeEach(func() {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			websocketHandler := handlers.NewWebsocketHandler(messagesChan, time.Minute)
+			handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				websocketHandler.ServeHTTP(rw, r.WithContext(ctx))
+			})
+		})
+
+		It("sends a going away close frame and stops all of its goroutines", func() {
+			ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			messagesChan <- []byte("message")
+			_, msg, err := ws.ReadMessage()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(msg)).To(Equal("message"))
+
+			cancel()
+			_, _, err = ws.ReadMessage()
+			Expect(err.Error()).To(ContainSubstring("websocket: close 1001"))
+
+			// The keep alive would only give up after a minute, so the handler
+			// returns this early only if it stopped its goroutines.
+			Eventually(handlerDone).Should(BeClosed())
+		})
+	})
+
+	Context("when the server shuts down", func() {
+		var registry *server.Registry
+
+		BeforeEach(func() {
+			registry = server.NewRegistry(5 * time.Second)
+			handler = registry.Handler(handlers.NewWebsocketHandler(messagesChan, time.Minute))
+		})
+
+		It("flushes buffered messages and tells the client to reconnect", func() {
+			ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(registry.Count).Should(Equal(1))
+
+			for i := 0; i < 5; i++ {
+				messagesChan <- []byte(fmt.Sprintf("message %d", i))
+			}
+			shutdownDone := make(chan error, 1)
+			go func() { shutdownDone <- registry.Shutdown(context.Background()) }()
+
+			for i := 0; i < 5; i++ {
+				_, msg, err := ws.ReadMessage()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(msg)).To(Equal(fmt.Sprintf("message %d", i)))
+			}
+			_, _, err = ws.ReadMessage()
+			Expect(err.Error()).To(ContainSubstring("websocket: close 1001"))
+			Expect(err.Error()).To(ContainSubstring("please reconnect in 5s"))
+
+			Eventually(shutdownDone).Should(Receive(BeNil()))
+			Eventually(handlerDone).Should(BeClosed())
+		})
+
+		It("refuses new streams", func() {
+			Expect(registry.Shutdown(context.Background())).To(Succeed())
+
+			_, resp, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+			Expect(err).To(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		})
+	})
+
 	Context("when client goes away", func() {
 		It("logs and appropriate message", func() {
 			ws, _, err := websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
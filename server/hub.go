@@ -0,0 +1,172 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/loggregatorlib/appid"
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+)
+
+const defaultSubscriptionBufferSize = 100
+
+// Hub fans published messages out to the subscribers of their app and to
+// every firehose subscriber. Each subscription has its own buffer; when a
+// subscriber falls behind its oldest messages are dropped, so a slow
+// subscriber never blocks Publish or the other subscribers.
+type Hub struct {
+	bufferSize int
+
+	sync.RWMutex
+	subscriptions map[string]map[*Subscription]struct{}
+	firehose      map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	hub      *Hub
+	appId    string
+	firehose bool
+	messages chan []byte
+	dropped  uint64
+	once     sync.Once
+}
+
+func NewHub(bufferSize int) *Hub {
+	if bufferSize <= 0 {
+		bufferSize = defaultSubscriptionBufferSize
+	}
+	return &Hub{
+		bufferSize:    bufferSize,
+		subscriptions: make(map[string]map[*Subscription]struct{}),
+		firehose:      make(map[*Subscription]struct{}),
+	}
+}
+
+func (h *Hub) Subscribe(appId string) *Subscription {
+	subscription := h.newSubscription(appId)
+
+	h.Lock()
+	defer h.Unlock()
+
+	subscriptions, ok := h.subscriptions[appId]
+	if !ok {
+		subscriptions = make(map[*Subscription]struct{})
+		h.subscriptions[appId] = subscriptions
+	}
+	subscriptions[subscription] = struct{}{}
+	return subscription
+}
+
+// SubscribeFirehose receives the messages of all apps.
+func (h *Hub) SubscribeFirehose() *Subscription {
+	subscription := h.newSubscription("")
+	subscription.firehose = true
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.firehose[subscription] = struct{}{}
+	return subscription
+}
+
+func (h *Hub) Publish(message *logmessage.Message) {
+	data := message.GetRawMessage()
+
+	h.RLock()
+	defer h.RUnlock()
+
+	for subscription := range h.subscriptions[message.GetLogMessage().GetAppId()] {
+		subscription.deliver(data)
+	}
+	for subscription := range h.firehose {
+		subscription.deliver(data)
+	}
+}
+
+// SubscriberCount returns the number of subscriptions for an app, not
+// counting the firehose.
+func (h *Hub) SubscriberCount(appId string) int {
+	h.RLock()
+	defer h.RUnlock()
+	return len(h.subscriptions[appId])
+}
+
+// Handler serves each request with the handler built by newHandler, fed by a
+// subscription to the app named in the request. The subscription ends when
+// the handler returns. Requests without an app are rejected.
+func (h *Hub) Handler(newHandler func(messages <-chan []byte) http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		appId := appid.FromUrl(r.URL)
+		if appId == "" {
+			http.Error(rw, "missing app parameter", http.StatusBadRequest)
+			return
+		}
+		serveSubscription(h.Subscribe(appId), newHandler, rw, r)
+	})
+}
+
+func (h *Hub) FirehoseHandler(newHandler func(messages <-chan []byte) http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		serveSubscription(h.SubscribeFirehose(), newHandler, rw, r)
+	})
+}
+
+func serveSubscription(subscription *Subscription, newHandler func(messages <-chan []byte) http.Handler, rw http.ResponseWriter, r *http.Request) {
+	defer subscription.Unsubscribe()
+	newHandler(subscription.Messages()).ServeHTTP(rw, r)
+}
+
+func (h *Hub) newSubscription(appId string) *Subscription {
+	return &Subscription{hub: h, appId: appId, messages: make(chan []byte, h.bufferSize)}
+}
+
+func (h *Hub) remove(subscription *Subscription) {
+	h.Lock()
+	defer h.Unlock()
+
+	if subscription.firehose {
+		delete(h.firehose, subscription)
+		return
+	}
+
+	subscriptions := h.subscriptions[subscription.appId]
+	delete(subscriptions, subscription)
+	if len(subscriptions) == 0 {
+		delete(h.subscriptions, subscription.appId)
+	}
+}
+
+// Messages is closed once the subscription is cancelled.
+func (s *Subscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+// Unsubscribe removes the subscription from the hub and closes its messages
+// channel. It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.hub.remove(s)
+		close(s.messages)
+	})
+}
+
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *Subscription) deliver(data []byte) {
+	for {
+		select {
+		case s.messages <- data:
+			return
+		default:
+		}
+
+		select {
+		case <-s.messages:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+	}
+}
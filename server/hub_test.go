@@ -0,0 +1,133 @@
+package server_test
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/cloudfoundry/loggregatorlib/logmessage"
+	"github.com/cloudfoundry/loggregatorlib/logmessage/testhelpers"
+	"github.com/cloudfoundry/loggregatorlib/server"
+	"github.com/cloudfoundry/loggregatorlib/server/handlers"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hub", func() {
+	var hub *server.Hub
+
+	newMessage := func(text, appId string) *logmessage.Message {
+		message, err := testhelpers.NewMessageWithError(text, appId)
+		Expect(err).NotTo(HaveOccurred())
+		return message
+	}
+
+	BeforeEach(func() {
+		hub = server.NewHub(2)
+	})
+
+	It("delivers messages to the subscribers of their app", func() {
+		first := hub.Subscribe("app-1")
+		second := hub.Subscribe("app-1")
+		other := hub.Subscribe("app-2")
+
+		message := newMessage("hello", "app-1")
+		hub.Publish(message)
+
+		Expect(first.Messages()).To(Receive(Equal(message.GetRawMessage())))
+		Expect(second.Messages()).To(Receive(Equal(message.GetRawMessage())))
+		Expect(other.Messages()).NotTo(Receive())
+	})
+
+	It("delivers messages of every app to firehose subscribers", func() {
+		firehose := hub.SubscribeFirehose()
+
+		hub.Publish(newMessage("one", "app-1"))
+		hub.Publish(newMessage("two", "app-2"))
+
+		Expect(firehose.Messages()).To(HaveLen(2))
+		Expect(hub.SubscriberCount("")).To(BeZero())
+	})
+
+	It("drops the oldest messages of a slow subscriber without blocking others", func() {
+		slow := hub.Subscribe("app-1")
+		fast := hub.Subscribe("app-1")
+
+		var published []*logmessage.Message
+		for i := 0; i < 5; i++ {
+			published = append(published, newMessage(fmt.Sprintf("message %d", i), "app-1"))
+			hub.Publish(published[i])
+			Eventually(fast.Messages()).Should(Receive())
+		}
+
+		Expect(slow.Dropped()).To(Equal(uint64(3)))
+		Expect(fast.Dropped()).To(BeZero())
+
+		Expect(slow.Messages()).To(Receive(Equal(published[3].GetRawMessage())))
+		Expect(slow.Messages()).To(Receive(Equal(published[4].GetRawMessage())))
+	})
+
+	It("closes the messages channel and stops delivering on unsubscribe", func() {
+		subscription := hub.Subscribe("app-1")
+		Expect(hub.SubscriberCount("app-1")).To(Equal(1))
+
+		subscription.Unsubscribe()
+		subscription.Unsubscribe()
+		hub.Publish(newMessage("hello", "app-1"))
+
+		Expect(hub.SubscriberCount("app-1")).To(BeZero())
+		Eventually(subscription.Messages()).Should(BeClosed())
+	})
+
+	Context("serving http requests", func() {
+		var testServer *httptest.Server
+
+		BeforeEach(func() {
+			testServer = httptest.NewServer(hub.Handler(func(messages <-chan []byte) http.Handler {
+				return handlers.NewHttpHandler(messages)
+			}))
+		})
+
+		AfterEach(func() {
+			testServer.Close()
+		})
+
+		It("subscribes each request to its app until the handler returns", func() {
+			request, err := http.NewRequest("GET", testServer.URL+"?app=app-1", nil)
+			Expect(err).NotTo(HaveOccurred())
+			request.Header.Set("Accept", "text/plain")
+
+			// The response headers are only flushed with the first message.
+			responses := make(chan *http.Response, 1)
+			go func() {
+				defer GinkgoRecover()
+				resp, err := http.DefaultClient.Do(request)
+				Expect(err).NotTo(HaveOccurred())
+				responses <- resp
+			}()
+			Eventually(func() int { return hub.SubscriberCount("app-1") }).Should(Equal(1))
+
+			hub.Publish(newMessage("hello", "app-1"))
+			var resp *http.Response
+			Eventually(responses).Should(Receive(&resp))
+			line, err := bufio.NewReader(resp.Body).ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+			Expect(strings.TrimSpace(line)).To(HaveSuffix("hello"))
+
+			resp.Body.Close()
+			Eventually(func() int {
+				hub.Publish(newMessage("wake up", "app-1"))
+				return hub.SubscriberCount("app-1")
+			}).Should(BeZero())
+		})
+
+		It("rejects requests without an app", func() {
+			resp, err := http.Get(testServer.URL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
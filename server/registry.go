@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ShutdownError is the cause of the request contexts cancelled by
+// Registry.Shutdown. Handlers use it to tell a server shutdown apart from a
+// client that went away, and to tell clients when to reconnect.
+type ShutdownError struct {
+	ReconnectAfter time.Duration
+}
+
+func (e *ShutdownError) Error() string {
+	return "server is shutting down"
+}
+
+// Hint is a human readable reconnect hint for close frames and responses.
+func (e *ShutdownError) Hint() string {
+	if e.ReconnectAfter <= 0 {
+		return "Server is shutting down, please reconnect."
+	}
+	return fmt.Sprintf("Server is shutting down, please reconnect in %s.", e.ReconnectAfter)
+}
+
+// ShutdownCause returns the ShutdownError if ctx was cancelled by a shutdown.
+func ShutdownCause(ctx context.Context) (*ShutdownError, bool) {
+	var shutdownErr *ShutdownError
+	if errors.As(context.Cause(ctx), &shutdownErr) {
+		return shutdownErr, true
+	}
+	return nil, false
+}
+
+// Registry tracks the log streams served through its Handler so that they can
+// be ended gracefully.
+type Registry struct {
+	ReconnectAfter time.Duration
+
+	sync.Mutex
+	closing bool
+	nextId  uint64
+	streams map[uint64]context.CancelCauseFunc
+	active  sync.WaitGroup
+}
+
+func NewRegistry(reconnectAfter time.Duration) *Registry {
+	return &Registry{
+		ReconnectAfter: reconnectAfter,
+		streams:        make(map[uint64]context.CancelCauseFunc),
+	}
+}
+
+// Handler registers every request served by h. Once Shutdown has been called
+// new requests are answered with 503 Service Unavailable.
+func (r *Registry) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithCancelCause(req.Context())
+		defer cancel(nil)
+
+		id, ok := r.register(cancel)
+		if !ok {
+			if r.ReconnectAfter > 0 {
+				rw.Header().Set("Retry-After", strconv.Itoa(int((r.ReconnectAfter+time.Second-1)/time.Second)))
+			}
+			http.Error(rw, r.shutdownError().Hint(), http.StatusServiceUnavailable)
+			return
+		}
+		defer r.unregister(id)
+
+		h.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// Count returns the number of active streams.
+func (r *Registry) Count() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.streams)
+}
+
+// Shutdown stops accepting streams, cancels the context of every active
+// stream with a ShutdownError and waits for their handlers to return. It
+// returns the context's error if ctx is done first.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.Lock()
+	r.closing = true
+	for _, cancel := range r.streams {
+		cancel(r.shutdownError())
+	}
+	r.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		r.active.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Registry) shutdownError() *ShutdownError {
+	return &ShutdownError{ReconnectAfter: r.ReconnectAfter}
+}
+
+func (r *Registry) register(cancel context.CancelCauseFunc) (uint64, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closing {
+		return 0, false
+	}
+	r.nextId++
+	r.streams[r.nextId] = cancel
+	r.active.Add(1)
+	return r.nextId, true
+}
+
+func (r *Registry) unregister(id uint64) {
+	r.Lock()
+	delete(r.streams, id)
+	r.Unlock()
+
+	r.active.Done()
+}
@@ -0,0 +1,104 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/server"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Registry", func() {
+	var (
+		registry   *server.Registry
+		testServer *httptest.Server
+		started    chan struct{}
+		causes     chan error
+		release    chan struct{}
+	)
+
+	BeforeEach(func() {
+		registry = server.NewRegistry(5 * time.Second)
+		started, causes, release = make(chan struct{}, 10), make(chan error, 10), make(chan struct{})
+		started, causes, release := started, causes, release
+		testServer = httptest.NewServer(registry.Handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			if r.URL.Query().Get("ignore_shutdown") != "" {
+				<-release
+				return
+			}
+			<-r.Context().Done()
+			causes <- context.Cause(r.Context())
+		})))
+	})
+
+	AfterEach(func() {
+		close(release)
+		testServer.Close()
+	})
+
+	get := func(query string) {
+		go func() {
+			resp, err := http.Get(testServer.URL + query)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		Eventually(started).Should(Receive())
+	}
+
+	It("cancels active streams with a shutdown error and waits for them", func() {
+		get("")
+		get("")
+		Expect(registry.Count()).To(Equal(2))
+
+		Expect(registry.Shutdown(context.Background())).To(Succeed())
+		Expect(registry.Count()).To(BeZero())
+
+		var cause error
+		Expect(causes).To(Receive(&cause))
+		Expect(cause).To(Equal(&server.ShutdownError{ReconnectAfter: 5 * time.Second}))
+		Expect(causes).To(Receive())
+	})
+
+	It("rejects new streams once shutting down", func() {
+		Expect(registry.Shutdown(context.Background())).To(Succeed())
+
+		resp, err := http.Get(testServer.URL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(resp.Header.Get("Retry-After")).To(Equal("5"))
+		Expect(started).NotTo(Receive())
+	})
+
+	It("gives up waiting when its context is done", func() {
+		get("?ignore_shutdown=true")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		Expect(registry.Shutdown(ctx)).To(Equal(context.DeadlineExceeded))
+		Expect(registry.Count()).To(Equal(1))
+	})
+
+	It("tells shutdowns apart from other cancellations", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, ok := server.ShutdownCause(ctx)
+		Expect(ok).To(BeFalse())
+
+		shutdown, ok := server.ShutdownCause(contextCancelledBy(&server.ShutdownError{}))
+		Expect(ok).To(BeTrue())
+		Expect(shutdown.Hint()).To(Equal("Server is shutting down, please reconnect."))
+		Expect((&server.ShutdownError{ReconnectAfter: time.Second}).Hint()).To(Equal("Server is shutting down, please reconnect in 1s."))
+	})
+})
+
+func contextCancelledBy(cause error) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+	return ctx
+}
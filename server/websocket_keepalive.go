@@ -1,54 +1,188 @@
 package server
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const defaultPingWriteDeadline = 5 * time.Second
+
+// StopReason tells why KeepAlive.Run returned.
+type StopReason int
+
+const (
+	PongTimeout StopReason = iota
+	PingFailed
+	Cancelled
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case PongTimeout:
+		return "pong timeout"
+	case PingFailed:
+		return "ping failed"
+	case Cancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+type KeepAliveOptions struct {
+	// PongTimeout is how long to wait for the pong to a ping.
+	PongTimeout time.Duration
+	// PingInterval is the pause between a pong and the next ping. It defaults
+	// to half of PongTimeout.
+	PingInterval  time.Duration
+	WriteDeadline time.Duration
+	Payload       []byte
+
+	// MaxMissedPongs is the number of consecutive pings that may go
+	// unanswered before Run gives up. It defaults to 1. OnMissedPong, if set,
+	// is called with the current count every time a pong is missed.
+	MaxMissedPongs int
+	OnMissedPong   func(missed int)
+}
+
+func (o KeepAliveOptions) withDefaults() KeepAliveOptions {
+	if o.PingInterval <= 0 {
+		o.PingInterval = o.PongTimeout / 2
+	}
+	if o.WriteDeadline <= 0 {
+		o.WriteDeadline = defaultPingWriteDeadline
+	}
+	if o.MaxMissedPongs <= 0 {
+		o.MaxMissedPongs = 1
+	}
+	return o
+}
+
+type KeepAliveStats struct {
+	PingsSent     uint64
+	PongsReceived uint64
+	MissedPongs   uint64
+	LastRTT       time.Duration
+}
+
 type KeepAlive struct {
-	conn              *websocket.Conn
-	pongChan          chan struct{}
-	keepAliveInterval time.Duration
+	conn     *websocket.Conn
+	pongChan chan struct{}
+	options  KeepAliveOptions
+
+	sync.Mutex
+	stats      KeepAliveStats
+	lastPingAt time.Time
 }
 
 func NewKeepAlive(conn *websocket.Conn, keepAliveInterval time.Duration) *KeepAlive {
+	return NewKeepAliveWithOptions(conn, KeepAliveOptions{PongTimeout: keepAliveInterval})
+}
+
+func NewKeepAliveWithOptions(conn *websocket.Conn, options KeepAliveOptions) *KeepAlive {
 	return &KeepAlive{
-		conn:              conn,
-		pongChan:          make(chan struct{}, 1),
-		keepAliveInterval: keepAliveInterval,
+		conn:     conn,
+		pongChan: make(chan struct{}, 1),
+		options:  options.withDefaults(),
 	}
 }
 
-func (k *KeepAlive) Run() {
+func (k *KeepAlive) Run() StopReason {
+	return k.RunContext(context.Background())
+}
+
+// RunContext also returns, with Cancelled, once ctx is done. Closing the
+// connection is left to the caller.
+func (k *KeepAlive) RunContext(ctx context.Context) StopReason {
+	// The pong handler stays installed after returning; resetting it here
+	// would race with the goroutine reading from the connection.
 	k.conn.SetPongHandler(k.pongHandler)
-	defer k.conn.SetPongHandler(nil)
 
-	timeout := time.NewTimer(k.keepAliveInterval)
+	missed := 0
 	for {
-		err := k.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
-		if err != nil {
-			return
+		// A pong that arrived after its ping timed out must not count for
+		// the next ping.
+		select {
+		case <-k.pongChan:
+		default:
 		}
 
-		if !timeout.Stop() {
-			<-timeout.C
+		if ctx.Err() != nil {
+			return Cancelled
+		}
+		k.pingSent()
+		err := k.conn.WriteControl(websocket.PingMessage, k.options.Payload, time.Now().Add(k.options.WriteDeadline))
+		if err != nil {
+			return PingFailed
 		}
-		timeout.Reset(k.keepAliveInterval)
+
+		timeout := time.NewTimer(k.options.PongTimeout)
 		select {
+		case <-ctx.Done():
+			timeout.Stop()
+			return Cancelled
 		case <-k.pongChan:
-			time.Sleep(k.keepAliveInterval / 2)
-			continue
+			timeout.Stop()
+			missed = 0
+			if !sleep(ctx, k.options.PingInterval) {
+				return Cancelled
+			}
 		case <-timeout.C:
-			return
+			missed++
+			k.pongMissed(missed)
+			if missed >= k.options.MaxMissedPongs {
+				return PongTimeout
+			}
 		}
 	}
 }
 
+func (k *KeepAlive) Stats() KeepAliveStats {
+	k.Lock()
+	defer k.Unlock()
+	return k.stats
+}
+
+func (k *KeepAlive) pingSent() {
+	k.Lock()
+	defer k.Unlock()
+	k.stats.PingsSent++
+	k.lastPingAt = time.Now()
+}
+
+func (k *KeepAlive) pongMissed(missed int) {
+	k.Lock()
+	k.stats.MissedPongs++
+	k.Unlock()
+
+	if k.options.OnMissedPong != nil {
+		k.options.OnMissedPong(missed)
+	}
+}
+
 func (k *KeepAlive) pongHandler(string) error {
+	k.Lock()
+	k.stats.PongsReceived++
+	k.stats.LastRTT = time.Since(k.lastPingAt)
+	k.Unlock()
+
 	select {
 	case k.pongChan <- struct{}{}:
 	default:
 	}
 	return nil
 }
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
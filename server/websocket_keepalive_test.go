@@ -1,6 +1,7 @@
 package server_test
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
@@ -18,11 +19,13 @@ var _ = Describe("WebsocketKeepalive", func() {
 		testServer         *httptest.Server
 		wsClient           *websocket.Conn
 		keepAliveCompleted chan struct{}
+		keepAliveReason    chan server.StopReason
 	)
 
 	BeforeEach(func() {
 		keepAliveCompleted = make(chan struct{})
-		testServer = httptest.NewServer(makeTestHandler(keepAliveCompleted))
+		keepAliveReason = make(chan server.StopReason, 1)
+		testServer = httptest.NewServer(makeTestHandler(keepAliveCompleted, keepAliveReason))
 		var err error
 		wsClient, _, err = websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
 		Expect(err).NotTo(HaveOccurred())
@@ -55,13 +58,133 @@ var _ = Describe("WebsocketKeepalive", func() {
 		go wsClient.ReadMessage()
 		Eventually(keepAliveCompleted).Should(BeClosed())
 	})
+
+	It("reports a pong timeout as the reason it stopped", func() {
+		wsClient.SetPingHandler(func(string) error { return nil })
+		go wsClient.ReadMessage()
+		Eventually(keepAliveCompleted).Should(BeClosed())
+		Expect(keepAliveReason).To(Receive(Equal(server.PongTimeout)))
+	})
+})
+
+var _ = Describe("WebsocketKeepalive with options", func() {
+	var (
+		testServer *httptest.Server
+		wsClient   *websocket.Conn
+		options    server.KeepAliveOptions
+		keepAlive  chan *server.KeepAlive
+		conns      chan *websocket.Conn
+		reasons    chan server.StopReason
+	)
+
+	start := func() {
+		keepAlive, reasons, conns = make(chan *server.KeepAlive, 1), make(chan server.StopReason, 1), make(chan *websocket.Conn, 1)
+		keepAlive, reasons, conns, options := keepAlive, reasons, conns, options
+		testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			conn, _ := websocket.Upgrade(rw, req, nil, 0, 0)
+			go conn.ReadMessage()
+			conns <- conn
+			k := server.NewKeepAliveWithOptions(conn, options)
+			keepAlive <- k
+			reasons <- k.Run()
+			conn.Close()
+		}))
+
+		var err error
+		wsClient, _, err = websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		options = server.KeepAliveOptions{PongTimeout: 50 * time.Millisecond}
+	})
+
+	AfterEach(func() {
+		wsClient.Close()
+		testServer.Close()
+	})
+
+	It("sends the configured payload and measures the round trip", func() {
+		options.Payload = []byte("are you there?")
+		start()
+
+		payloads := make(chan string, 10)
+		wsClient.SetPingHandler(func(payload string) error {
+			payloads <- payload
+			return wsClient.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(time.Second))
+		})
+		go wsClient.ReadMessage()
+
+		Eventually(payloads).Should(Receive(Equal("are you there?")))
+		k := <-keepAlive
+		Eventually(func() uint64 { return k.Stats().PongsReceived }).Should(BeNumerically(">=", 1))
+		stats := k.Stats()
+		Expect(stats.PingsSent).To(BeNumerically(">=", stats.PongsReceived))
+		Expect(stats.LastRTT).To(BeNumerically(">", 0))
+		Expect(stats.MissedPongs).To(BeZero())
+	})
+
+	It("tolerates missed pongs up to the configured maximum", func() {
+		missed := make(chan int, 10)
+		options.MaxMissedPongs = 3
+		options.OnMissedPong = func(count int) { missed <- count }
+		start()
+
+		wsClient.SetPingHandler(func(string) error { return nil })
+		go wsClient.ReadMessage()
+
+		Eventually(reasons).Should(Receive(Equal(server.PongTimeout)))
+		Expect(missed).To(Receive(Equal(1)))
+		Expect(missed).To(Receive(Equal(2)))
+		Expect(missed).To(Receive(Equal(3)))
+		Expect((<-keepAlive).Stats().MissedPongs).To(Equal(uint64(3)))
+	})
+
+	It("stops when its context is cancelled", func() {
+		options.PongTimeout = time.Minute
+		keepAlive, reasons = make(chan *server.KeepAlive, 1), make(chan server.StopReason, 1)
+		ctx, cancel := context.WithCancel(context.Background())
+		keepAlive, reasons := keepAlive, reasons
+		testServer = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			conn, _ := websocket.Upgrade(rw, req, nil, 0, 0)
+			go conn.ReadMessage()
+			k := server.NewKeepAliveWithOptions(conn, options)
+			keepAlive <- k
+			reasons <- k.RunContext(ctx)
+			conn.Close()
+		}))
+
+		var err error
+		wsClient, _, err = websocket.DefaultDialer.Dial(httpToWs(testServer.URL), nil)
+		Expect(err).NotTo(HaveOccurred())
+		wsClient.SetPingHandler(func(string) error { return nil })
+		go wsClient.ReadMessage()
+
+		k := <-keepAlive
+		Eventually(func() uint64 { return k.Stats().PingsSent }).Should(Equal(uint64(1)))
+		cancel()
+		Eventually(reasons).Should(Receive(Equal(server.Cancelled)))
+	})
+
+	It("reports a failed ping write as the reason it stopped", func() {
+		options.PingInterval = 10 * time.Millisecond
+		options.MaxMissedPongs = 100
+		start()
+
+		go wsClient.ReadMessage()
+		k := <-keepAlive
+		Eventually(func() uint64 { return k.Stats().PongsReceived }).Should(BeNumerically(">=", 1))
+		(<-conns).Close()
+
+		Eventually(reasons).Should(Receive(Equal(server.PingFailed)))
+	})
 })
 
-func makeTestHandler(keepAliveCompleted chan struct{}) http.Handler {
+func makeTestHandler(keepAliveCompleted chan struct{}, reason chan server.StopReason) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		conn, _ := websocket.Upgrade(rw, req, nil, 0, 0)
 		go conn.ReadMessage()
-		server.NewKeepAlive(conn, 50*time.Millisecond).Run()
+		reason <- server.NewKeepAlive(conn, 50*time.Millisecond).Run()
 		close(keepAliveCompleted)
 	})
 }
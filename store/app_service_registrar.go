@@ -0,0 +1,284 @@
+package store
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/cloudfoundry/storeadapter"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+)
+
+var (
+	ErrInvalidAppId  = errors.New("app id must not be empty or contain a slash")
+	ErrAppIdMismatch = errors.New("app service belongs to another app")
+)
+
+type AppServiceRegistrarOptions struct {
+	// KeyPrefix defaults to DefaultKeyPrefix.
+	KeyPrefix string
+	// UrlPolicy validates and normalizes drain urls before they are written.
+	UrlPolicy appservice.UrlPolicy
+	// TTL is the lifetime of the written entries in seconds; 0 keeps them
+	// until they are deleted. Entries with a TTL stay alive as long as they are
+	// written again, e.g. by calling Sync periodically.
+	TTL uint64
+}
+
+func (o AppServiceRegistrarOptions) withDefaults() AppServiceRegistrarOptions {
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = DefaultKeyPrefix
+	}
+	o.KeyPrefix = path.Clean("/" + o.KeyPrefix)
+	return o
+}
+
+// AppServiceRegistrar writes app services to the store in the layout read by
+// AppServiceStoreWatcher: <prefix>/<appId>/<id> holding AppService.StoreValue.
+// App services that are already registered under another key, like the hash
+// of their url as it was written before it was normalized, are kept and
+// changed under that key.
+type AppServiceRegistrar struct {
+	adapter storeadapter.StoreAdapter
+	options AppServiceRegistrarOptions
+}
+
+func NewAppServiceRegistrar(adapter storeadapter.StoreAdapter) *AppServiceRegistrar {
+	return NewAppServiceRegistrarWithOptions(adapter, AppServiceRegistrarOptions{})
+}
+
+func NewAppServiceRegistrarWithOptions(adapter storeadapter.StoreAdapter, options AppServiceRegistrarOptions) *AppServiceRegistrar {
+	return &AppServiceRegistrar{adapter: adapter, options: options.withDefaults()}
+}
+
+// Key returns the store key of a new app service. The url should already be
+// normalized, as it is by all writing methods.
+func (r *AppServiceRegistrar) Key(appService appservice.AppService) string {
+	return path.Join(r.appKey(appService.AppId), appService.Id())
+}
+
+// Create fails with storeadapter.ErrorKeyExists if the app service is
+// already registered.
+func (r *AppServiceRegistrar) Create(appService appservice.AppService) error {
+	node, err := r.node(appService)
+	if err != nil {
+		return err
+	}
+	keys, err := r.keys(appService)
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return storeadapter.ErrorKeyExists
+	}
+	return r.adapter.Create(node)
+}
+
+// Update replaces the metadata of a registered app service and fails with
+// storeadapter.ErrorKeyNotFound if there is none.
+func (r *AppServiceRegistrar) Update(appService appservice.AppService) error {
+	node, err := r.node(appService)
+	if err != nil {
+		return err
+	}
+	keys, err := r.keys(appService)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return storeadapter.ErrorKeyNotFound
+	}
+	for _, key := range keys {
+		node.Key = key
+		if err := r.adapter.Update(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete fails with storeadapter.ErrorKeyNotFound if the app service is not
+// registered.
+func (r *AppServiceRegistrar) Delete(appService appservice.AppService) error {
+	keys, err := r.keys(appService)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return storeadapter.ErrorKeyNotFound
+	}
+	return r.adapter.Delete(keys...)
+}
+
+// DeleteApp removes all app services of an app.
+func (r *AppServiceRegistrar) DeleteApp(appId string) error {
+	if !validAppId(appId) {
+		return ErrInvalidAppId
+	}
+	err := r.adapter.Delete(r.appKey(appId))
+	if err == storeadapter.ErrorKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// Sync makes appServices the complete set of app services of an app. New and
+// changed ones are written, unchanged ones only if they need their TTL
+// refreshed, and registered app services that are not among them are
+// deleted. Nothing is written if any of them is invalid or belongs to another
+// app.
+func (r *AppServiceRegistrar) Sync(appId string, appServices []appservice.AppService) error {
+	if !validAppId(appId) {
+		return ErrInvalidAppId
+	}
+	if len(appServices) == 0 {
+		return r.DeleteApp(appId)
+	}
+
+	normalized := make([]appservice.AppService, 0, len(appServices))
+	wanted := make(map[string]appservice.AppService)
+	for _, appService := range appServices {
+		if appService.AppId != appId {
+			return ErrAppIdMismatch
+		}
+		appService, err := r.normalize(appService)
+		if err != nil {
+			return err
+		}
+		normalized = append(normalized, appService)
+		wanted[appService.Id()] = appService
+	}
+
+	registered, err := r.registered(appId)
+	if err != nil {
+		return err
+	}
+
+	var nodes []storeadapter.StoreNode
+	var stale []string
+	kept := make(map[string]bool)
+	for _, node := range registered {
+		stored, ok := r.decode(node)
+		appService, isWanted := wanted[stored.Id()]
+		if !ok || !isWanted {
+			stale = append(stale, node.Key)
+			continue
+		}
+
+		kept[appService.Id()] = true
+		if !stored.Equal(appService) {
+			node, err = r.storeNode(node.Key, appService)
+			if err != nil {
+				return err
+			}
+			nodes = append(nodes, node)
+		} else if r.options.TTL > 0 {
+			nodes = append(nodes, storeadapter.StoreNode{Key: node.Key, Value: node.Value, TTL: r.options.TTL})
+		}
+	}
+	for _, appService := range normalized {
+		if kept[appService.Id()] {
+			continue
+		}
+		kept[appService.Id()] = true
+		node, err := r.storeNode(r.Key(appService), appService)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+
+	if len(nodes) > 0 {
+		if err := r.adapter.SetMulti(nodes); err != nil {
+			return err
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	err = r.adapter.Delete(stale...)
+	if err == storeadapter.ErrorKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+func (r *AppServiceRegistrar) appKey(appId string) string {
+	return r.options.KeyPrefix + "/" + appId
+}
+
+// registered returns the app service nodes of an app.
+func (r *AppServiceRegistrar) registered(appId string) ([]storeadapter.StoreNode, error) {
+	app, err := r.adapter.ListRecursively(r.appKey(appId))
+	if err == storeadapter.ErrorKeyNotFound {
+		return nil, nil
+	}
+	return app.ChildNodes, err
+}
+
+// keys returns the keys of the nodes that hold the app service.
+func (r *AppServiceRegistrar) keys(appService appservice.AppService) ([]string, error) {
+	appService, err := r.normalize(appService)
+	if err != nil {
+		return nil, err
+	}
+	registered, err := r.registered(appService.AppId)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, node := range registered {
+		if stored, ok := r.decode(node); ok && stored.Id() == appService.Id() {
+			keys = append(keys, node.Key)
+		}
+	}
+	return keys, nil
+}
+
+// decode reads a registered node the way a watcher normalizing its urls with
+// the same policy would.
+func (r *AppServiceRegistrar) decode(node storeadapter.StoreNode) (appservice.AppService, bool) {
+	if node.Dir {
+		return appservice.AppService{}, false
+	}
+	appService, err := DecodeAppServiceNode(r.options.KeyPrefix, &node)
+	if err != nil {
+		return appservice.AppService{}, false
+	}
+	appService, err = r.normalize(appService)
+	return appService, err == nil
+}
+
+func (r *AppServiceRegistrar) node(appService appservice.AppService) (storeadapter.StoreNode, error) {
+	appService, err := r.normalize(appService)
+	if err != nil {
+		return storeadapter.StoreNode{}, err
+	}
+	return r.storeNode(r.Key(appService), appService)
+}
+
+func (r *AppServiceRegistrar) storeNode(key string, appService appservice.AppService) (storeadapter.StoreNode, error) {
+	value, err := appService.StoreValue()
+	if err != nil {
+		return storeadapter.StoreNode{}, err
+	}
+	return storeadapter.StoreNode{Key: key, Value: value, TTL: r.options.TTL}, nil
+}
+
+func (r *AppServiceRegistrar) normalize(appService appservice.AppService) (appservice.AppService, error) {
+	if !validAppId(appService.AppId) {
+		return appservice.AppService{}, ErrInvalidAppId
+	}
+	url, err := r.options.UrlPolicy.Normalize(appService.Url)
+	if err != nil {
+		return appservice.AppService{}, err
+	}
+	appService.Url = url
+	return appService, nil
+}
+
+func validAppId(appId string) bool {
+	return appId != "" && !strings.Contains(appId, "/")
+}
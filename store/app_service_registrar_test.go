@@ -0,0 +1,189 @@
+package store_test
+
+import (
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	. "github.com/cloudfoundry/loggregatorlib/store"
+	"github.com/cloudfoundry/loggregatorlib/store/cache"
+	"github.com/cloudfoundry/loggregatorlib/store/memorystoreadapter"
+	"github.com/cloudfoundry/storeadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AppServiceRegistrar", func() {
+	var adapter *memorystoreadapter.MemoryStoreAdapter
+	var registrar *AppServiceRegistrar
+
+	drain := appservice.AppService{AppId: "app-1", Url: "syslog://Drain.example.com"}
+	normalized := appservice.AppService{AppId: "app-1", Url: "syslog://drain.example.com:514"}
+	other := appservice.AppService{AppId: "app-1", Url: "syslog://other.example.com:514"}
+
+	BeforeEach(func() {
+		adapter = memorystoreadapter.New()
+		registrar = NewAppServiceRegistrar(adapter)
+	})
+
+	It("writes normalized app services in the layout the watcher reads", func() {
+		Expect(registrar.Create(drain)).To(Succeed())
+		Expect(registrar.Create(drain)).To(Equal(storeadapter.ErrorKeyExists))
+
+		node := storedNode(adapter, "/loggregator/services/app-1/"+normalized.Id())
+		Expect(node.Value).To(Equal([]byte("syslog://drain.example.com:514")))
+		Expect(DecodeAppServiceNode("/loggregator/services", &node)).To(Equal(normalized))
+	})
+
+	It("updates the metadata of registered app services only", func() {
+		Expect(registrar.Update(drain)).To(Equal(storeadapter.ErrorKeyNotFound))
+		Expect(registrar.Create(drain)).To(Succeed())
+
+		drain := drain
+		drain.Type = appservice.DrainTypeLogs
+		Expect(registrar.Update(drain)).To(Succeed())
+
+		node := storedNode(adapter, registrar.Key(normalized))
+		Expect(DecodeAppServiceNode("/loggregator/services", &node)).To(Equal(appservice.AppService{AppId: "app-1", Url: normalized.Url, Type: appservice.DrainTypeLogs}))
+	})
+
+	It("deletes app services and whole apps", func() {
+		Expect(registrar.Create(drain)).To(Succeed())
+		Expect(registrar.Create(other)).To(Succeed())
+
+		Expect(registrar.Delete(drain)).To(Succeed())
+		Expect(storedKeys(adapter)).To(Equal([]string{registrar.Key(other)}))
+
+		Expect(registrar.DeleteApp("app-1")).To(Succeed())
+		Expect(storedKeys(adapter)).To(BeEmpty())
+		Expect(registrar.DeleteApp("app-1")).To(Succeed())
+	})
+
+	It("writes entries with the configured key prefix and TTL", func() {
+		registrar = NewAppServiceRegistrarWithOptions(adapter, AppServiceRegistrarOptions{KeyPrefix: "/deployment-a/drains/", TTL: 60})
+		Expect(registrar.Create(drain)).To(Succeed())
+
+		Expect(storedKeys(adapter)).To(Equal([]string{"/deployment-a/drains/app-1/" + normalized.Id()}))
+		Expect(storedNode(adapter, registrar.Key(normalized)).TTL).To(Equal(uint64(60)))
+	})
+
+	It("rejects invalid app services", func() {
+		Expect(registrar.Create(appservice.AppService{AppId: "app/1", Url: drain.Url})).To(Equal(ErrInvalidAppId))
+		Expect(registrar.Create(appservice.AppService{AppId: "app-1", Url: "syslog://127.0.0.1"})).To(Equal(appservice.ErrInternalAddress))
+		Expect(storedKeys(adapter)).To(BeEmpty())
+	})
+
+	Describe("Sync", func() {
+		third := appservice.AppService{AppId: "app-1", Url: "syslog://third.example.com:514"}
+
+		BeforeEach(func() {
+			Expect(registrar.Create(drain)).To(Succeed())
+			Expect(registrar.Create(other)).To(Succeed())
+			Expect(registrar.Create(appservice.AppService{AppId: "app-2", Url: drain.Url})).To(Succeed())
+		})
+
+		It("replaces the app services of an app", func() {
+			Expect(registrar.Sync("app-1", []appservice.AppService{other, third})).To(Succeed())
+
+			Expect(storedKeys(adapter)).To(ConsistOf(
+				registrar.Key(other),
+				registrar.Key(third),
+				registrar.Key(appservice.AppService{AppId: "app-2", Url: normalized.Url}),
+			))
+		})
+
+		It("removes the app when it has no app services left", func() {
+			Expect(registrar.Sync("app-1", nil)).To(Succeed())
+			Expect(storedKeys(adapter)).To(HaveLen(1))
+		})
+
+		It("writes nothing if an app service is invalid or belongs to another app", func() {
+			Expect(registrar.Sync("app-1", []appservice.AppService{third, {AppId: "app-2", Url: third.Url}})).To(Equal(ErrAppIdMismatch))
+			Expect(registrar.Sync("app-1", []appservice.AppService{third, {AppId: "app-1", Url: "ftp://example.com"}})).To(Equal(appservice.ErrUnsupportedScheme))
+			Expect(storedKeys(adapter)).To(HaveLen(3))
+		})
+	})
+
+	Describe("with an app service under a legacy key", func() {
+		legacyKey := "/loggregator/services/app-1/" + drain.Id()
+
+		BeforeEach(func() {
+			Expect(adapter.Create(storeadapter.StoreNode{Key: legacyKey, Value: []byte(drain.Url)})).To(Succeed())
+		})
+
+		It("does not register it again", func() {
+			Expect(registrar.Create(normalized)).To(Equal(storeadapter.ErrorKeyExists))
+			Expect(storedKeys(adapter)).To(Equal([]string{legacyKey}))
+		})
+
+		It("updates and deletes it under its legacy key", func() {
+			drain := drain
+			drain.Type = appservice.DrainTypeLogs
+			Expect(registrar.Update(drain)).To(Succeed())
+
+			node := storedNode(adapter, legacyKey)
+			Expect(DecodeAppServiceNode("/loggregator/services", &node)).To(Equal(appservice.AppService{AppId: "app-1", Url: normalized.Url, Type: appservice.DrainTypeLogs}))
+
+			Expect(registrar.Delete(normalized)).To(Succeed())
+			Expect(storedKeys(adapter)).To(BeEmpty())
+			Expect(registrar.Delete(normalized)).To(Equal(storeadapter.ErrorKeyNotFound))
+		})
+
+		It("leaves it untouched when syncing", func() {
+			Expect(registrar.Sync("app-1", []appservice.AppService{drain, other})).To(Succeed())
+
+			Expect(storedKeys(adapter)).To(ConsistOf(legacyKey, registrar.Key(other)))
+			Expect(storedNode(adapter, legacyKey)).To(Equal(storeadapter.StoreNode{Key: legacyKey, Value: []byte(drain.Url), Index: 1}))
+		})
+
+		It("only refreshes its TTL when syncing with a TTL", func() {
+			registrar = NewAppServiceRegistrarWithOptions(adapter, AppServiceRegistrarOptions{TTL: 60})
+			Expect(registrar.Sync("app-1", []appservice.AppService{normalized})).To(Succeed())
+
+			node := storedNode(adapter, legacyKey)
+			Expect(node.Value).To(Equal([]byte(drain.Url)))
+			Expect(node.TTL).To(Equal(uint64(60)))
+			Expect(storedKeys(adapter)).To(Equal([]string{legacyKey}))
+		})
+
+		It("keeps it in the cache of a watcher when syncing", func() {
+			watcherCache := cache.NewAppServiceCache()
+			watcher, events := NewAppServiceStoreEventWatcher(adapter, watcherCache, AppServiceStoreWatcherOptions{UrlPolicy: &appservice.UrlPolicy{}})
+			go watcher.Run()
+			defer watcher.Stop()
+
+			var event Event
+			Eventually(events).Should(Receive(&event))
+			Expect(event.AppService).To(Equal(normalized))
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(Resynced))
+
+			Expect(registrar.Sync("app-1", []appservice.AppService{drain, other})).To(Succeed())
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(Added))
+			Expect(event.AppService).To(Equal(other))
+			Consistently(events).ShouldNot(Receive())
+			Expect(watcherCache.Get("app-1")).To(ConsistOf(normalized, other))
+		})
+	})
+})
+
+func storedKeys(adapter storeadapter.StoreAdapter) []string {
+	var keys []string
+	var collect func(node storeadapter.StoreNode)
+	collect = func(node storeadapter.StoreNode) {
+		if !node.Dir {
+			keys = append(keys, node.Key)
+		}
+		for _, child := range node.ChildNodes {
+			collect(child)
+		}
+	}
+
+	root, _ := adapter.ListRecursively("/")
+	collect(root)
+	return keys
+}
+
+func storedNode(adapter storeadapter.StoreAdapter, key string) storeadapter.StoreNode {
+	node, err := adapter.Get(key)
+	Expect(err).NotTo(HaveOccurred())
+	return node
+}
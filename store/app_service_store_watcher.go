@@ -1,8 +1,13 @@
 package store
 
 import (
+	"errors"
 	"log"
+	"math/rand"
 	"path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudfoundry/storeadapter"
 
@@ -10,48 +15,338 @@ import (
 	"github.com/cloudfoundry/loggregatorlib/store/cache"
 )
 
+const (
+	DefaultKeyPrefix = "/loggregator/services"
+
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+
+	defaultDeliveryBufferSize = 1024
+)
+
+var ErrInvalidNodeKey = errors.New("store node key is not of the form <prefix>/<appId>/<id>")
+
+// NodeDecoder turns a leaf node below the key prefix into an AppService.
+type NodeDecoder func(prefix string, node *storeadapter.StoreNode) (appservice.AppService, error)
+
+// Health tells how far the watcher's cache can be trusted. It is Connected
+// while the watch is up and the last listing succeeded, Resyncing while the
+// watch is being re-established and Degraded while the store cannot be listed.
+type Health int32
+
+const (
+	Connected Health = iota
+	Resyncing
+	Degraded
+)
+
+func (h Health) String() string {
+	switch h {
+	case Connected:
+		return "connected"
+	case Resyncing:
+		return "resyncing"
+	case Degraded:
+		return "degraded"
+	}
+	return "unknown"
+}
+
+// DeliveryMode decides how the watcher hands app services to its consumer.
+type DeliveryMode int
+
+const (
+	// DeliverUnbuffered sends on unbuffered channels, so the store event loop
+	// waits for the consumer.
+	DeliverUnbuffered DeliveryMode = iota
+	// DeliverBuffered buffers up to DeliveryBufferSize changes; the event loop
+	// only waits for the consumer once the buffer is full. Adds and removes
+	// share the buffer, so they reach the add and remove channels in order.
+	DeliverBuffered
+	// DeliverCoalesced queues app services without bound and drops an add
+	// together with a remove of the same app service if the add has not been
+	// consumed yet. The order of adds and removes is kept.
+	DeliverCoalesced
+)
+
+type DeliveryStats struct {
+	// Depth is the number of app services waiting for the consumer.
+	Depth int
+	// Lag is how long the oldest of them has been waiting. It is only
+	// tracked for DeliverCoalesced.
+	Lag time.Duration
+	// Coalesced counts the adds and removes that cancelled each other out.
+	Coalesced uint64
+}
+
+type AppServiceStoreWatcherOptions struct {
+	// KeyPrefix is the directory holding one subdirectory per app. It
+	// defaults to DefaultKeyPrefix.
+	KeyPrefix string
+	// DecodeNode defaults to DecodeAppServiceNode.
+	DecodeNode NodeDecoder
+	// UrlPolicy, if set, validates and normalizes the drain url of every
+	// decoded node. Without it urls are passed on as they are stored.
+	UrlPolicy *appservice.UrlPolicy
+	// OnRejected, if set, is called with every node that is ignored because
+	// it could not be decoded or its url was rejected.
+	OnRejected func(node storeadapter.StoreNode, err error)
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between attempts
+	// to re-establish a failed watch or to list the store again.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnError, if set, is called with every watch and listing error.
+	OnError func(err error)
+
+	Delivery DeliveryMode
+	// DeliveryBufferSize is the capacity of the buffer for DeliverBuffered.
+	// It defaults to 1024.
+	DeliveryBufferSize int
+}
+
+func (o AppServiceStoreWatcherOptions) withDefaults() AppServiceStoreWatcherOptions {
+	if o.KeyPrefix == "" {
+		o.KeyPrefix = DefaultKeyPrefix
+	}
+	o.KeyPrefix = path.Clean("/" + o.KeyPrefix)
+	if o.DecodeNode == nil {
+		o.DecodeNode = DecodeAppServiceNode
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = defaultMinBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = o.MinBackoff
+	}
+	if o.DeliveryBufferSize <= 0 {
+		o.DeliveryBufferSize = defaultDeliveryBufferSize
+	}
+	return o
+}
+
 type AppServiceStoreWatcher struct {
 	adapter                   storeadapter.StoreAdapter
 	outAddChan, outRemoveChan chan<- appservice.AppService
+	events                    chan<- Event
+	sequence                  uint64
+	subscriptions             subscriptions
 	cache                     cache.AppServiceWatcherCache
+	storeKeys                 *storeKeys
+	options                   AppServiceStoreWatcherOptions
+	health                    int32
+	queue                     *deliveryQueue
+	buffered                  chan Event
+	pending                   int64
 
 	done chan struct{}
 }
 
 func NewAppServiceStoreWatcher(adapter storeadapter.StoreAdapter, cache cache.AppServiceWatcherCache) (*AppServiceStoreWatcher, <-chan appservice.AppService, <-chan appservice.AppService) {
+	return NewAppServiceStoreWatcherWithOptions(adapter, cache, AppServiceStoreWatcherOptions{})
+}
+
+func NewAppServiceStoreWatcherWithOptions(adapter storeadapter.StoreAdapter, cache cache.AppServiceWatcherCache, options AppServiceStoreWatcherOptions) (*AppServiceStoreWatcher, <-chan appservice.AppService, <-chan appservice.AppService) {
+	watcher := newAppServiceStoreWatcher(adapter, cache, options)
+	if watcher.options.Delivery == DeliverBuffered {
+		watcher.buffered = make(chan Event, watcher.options.DeliveryBufferSize)
+	}
 	outAddChan := make(chan appservice.AppService)
 	outRemoveChan := make(chan appservice.AppService)
-	return &AppServiceStoreWatcher{
-		adapter:       adapter,
-		outAddChan:    outAddChan,
-		outRemoveChan: outRemoveChan,
-		cache:         cache,
-		done:          make(chan struct{}),
-	}, outAddChan, outRemoveChan
+	watcher.outAddChan, watcher.outRemoveChan = outAddChan, outRemoveChan
+	return watcher, outAddChan, outRemoveChan
 }
 
-func (w *AppServiceStoreWatcher) Add(appService appservice.AppService) {
-	if !w.cache.Exists(appService) {
-		w.cache.Add(appService)
-		w.outAddChan <- appService
+// NewAppServiceStoreEventWatcher delivers all changes in order on a single
+// channel of events instead of separate add and remove channels.
+func NewAppServiceStoreEventWatcher(adapter storeadapter.StoreAdapter, cache cache.AppServiceWatcherCache, options AppServiceStoreWatcherOptions) (*AppServiceStoreWatcher, <-chan Event) {
+	watcher := newAppServiceStoreWatcher(adapter, cache, options)
+	events := make(chan Event, watcher.bufferSize())
+	watcher.events = events
+	return watcher, events
+}
+
+// NewAppServiceStoreSubscriptionWatcher only delivers changes to the handlers
+// passed to Subscribe. Without a channel to wait on, the store event loop is
+// never held up by a consumer.
+func NewAppServiceStoreSubscriptionWatcher(adapter storeadapter.StoreAdapter, cache cache.AppServiceWatcherCache, options AppServiceStoreWatcherOptions) *AppServiceStoreWatcher {
+	return newAppServiceStoreWatcher(adapter, cache, options)
+}
+
+func newAppServiceStoreWatcher(adapter storeadapter.StoreAdapter, cache cache.AppServiceWatcherCache, options AppServiceStoreWatcherOptions) *AppServiceStoreWatcher {
+	watcher := &AppServiceStoreWatcher{
+		adapter:   adapter,
+		cache:     cache,
+		storeKeys: newStoreKeys(),
+		options:   options.withDefaults(),
+		health:    int32(Resyncing),
+		done:      make(chan struct{}),
+	}
+	if watcher.options.Delivery == DeliverCoalesced {
+		watcher.queue = newDeliveryQueue()
 	}
+	return watcher
 }
 
-func (w *AppServiceStoreWatcher) Remove(appService appservice.AppService) {
-	if w.cache.Exists(appService) {
-		w.cache.Remove(appService)
-		w.outRemoveChan <- appService
+func (w *AppServiceStoreWatcher) bufferSize() int {
+	if w.options.Delivery == DeliverBuffered {
+		return w.options.DeliveryBufferSize
 	}
+	return 0
+}
+
+func (w *AppServiceStoreWatcher) Add(appService appservice.AppService) {
+	w.add(appService, 0)
+}
+
+func (w *AppServiceStoreWatcher) Remove(appService appservice.AppService) {
+	w.remove(appService, 0)
 }
 
 func (w *AppServiceStoreWatcher) RemoveApp(appId string) []appservice.AppService {
+	return w.removeApp(appId, 0)
+}
+
+// add caches the app service. An app service that is already cached with other
+// credentials or metadata is removed and added again, so consumers always see
+// the current one.
+func (w *AppServiceStoreWatcher) add(appService appservice.AppService, index uint64) {
+	cached, ok := w.cached(appService)
+	if ok && cached.Equal(appService) {
+		return
+	}
+	w.cache.Add(appService)
+	if ok {
+		w.deliver(Event{Type: Removed, AppId: cached.AppId, AppService: cached, Index: index})
+	}
+	w.deliver(Event{Type: Added, AppId: appService.AppId, AppService: appService, Index: index})
+}
+
+func (w *AppServiceStoreWatcher) remove(appService appservice.AppService, index uint64) {
+	if cached, ok := w.cached(appService); ok {
+		w.cache.Remove(cached)
+		w.deliver(Event{Type: Removed, AppId: cached.AppId, AppService: cached, Index: index})
+	}
+}
+
+// cached returns the cached app service with the same Id.
+func (w *AppServiceStoreWatcher) cached(appService appservice.AppService) (appservice.AppService, bool) {
+	for _, cached := range w.cache.Get(appService.AppId) {
+		if cached.Id() == appService.Id() {
+			return cached, true
+		}
+	}
+	return appservice.AppService{}, false
+}
+
+func (w *AppServiceStoreWatcher) removeApp(appId string, index uint64) []appservice.AppService {
 	appServices := w.cache.RemoveApp(appId)
-	for _, appService := range appServices {
-		w.outRemoveChan <- appService
+	if len(appServices) > 0 {
+		w.deliver(Event{Type: AppRemoved, AppId: appId, AppServices: appServices, Index: index})
 	}
 	return appServices
 }
 
+func (w *AppServiceStoreWatcher) DeliveryStats() DeliveryStats {
+	if w.queue != nil {
+		return w.queue.stats()
+	}
+	if w.buffered != nil {
+		return DeliveryStats{Depth: int(atomic.LoadInt64(&w.pending))}
+	}
+	return DeliveryStats{Depth: len(w.events) + len(w.outAddChan) + len(w.outRemoveChan)}
+}
+
+// deliver numbers the event and hands it to the subscribers and the consumer.
+// The add and remove channels get AppRemoved as one removal per app service
+// and no Resynced.
+func (w *AppServiceStoreWatcher) deliver(event Event) {
+	event.Sequence = atomic.AddUint64(&w.sequence, 1)
+	w.publish(event)
+
+	if w.events == nil && w.outAddChan == nil {
+		return
+	}
+	if w.events != nil {
+		w.enqueue(event)
+		return
+	}
+	switch event.Type {
+	case Added, Removed:
+		w.enqueue(event)
+	case AppRemoved:
+		for _, appService := range event.AppServices {
+			w.enqueue(Event{Type: Removed, AppId: event.AppId, AppService: appService, Sequence: event.Sequence, Index: event.Index})
+		}
+	}
+}
+
+func (w *AppServiceStoreWatcher) enqueue(event Event) {
+	if w.queue != nil {
+		w.queue.push(event)
+		return
+	}
+	if w.buffered != nil {
+		atomic.AddInt64(&w.pending, 1)
+		w.buffered <- event
+		return
+	}
+	w.send(event, nil)
+}
+
+// forward hands the buffered events to the consumer in order until stopped
+// is closed. Whatever is still buffered at that point is dropped.
+func (w *AppServiceStoreWatcher) forward(stopped <-chan struct{}) {
+	for {
+		select {
+		case event := <-w.buffered:
+			if !w.send(event, stopped) {
+				return
+			}
+			atomic.AddInt64(&w.pending, -1)
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// send returns false if stopped is closed before the consumer took the event.
+func (w *AppServiceStoreWatcher) send(event Event, stopped <-chan struct{}) bool {
+	if w.events != nil {
+		select {
+		case w.events <- event:
+			return true
+		case <-stopped:
+			return false
+		}
+	}
+
+	out := w.outAddChan
+	if event.Type == Removed {
+		out = w.outRemoveChan
+	}
+	select {
+	case out <- event.AppService:
+		return true
+	case <-stopped:
+		return false
+	}
+}
+
+func (w *AppServiceStoreWatcher) closeOut() {
+	if w.events != nil {
+		close(w.events)
+	}
+	if w.outAddChan == nil {
+		return
+	}
+	close(w.outAddChan)
+	close(w.outRemoveChan)
+}
+
 func (w *AppServiceStoreWatcher) Get(appId string) []appservice.AppService {
 	return w.cache.Get(appId)
 }
@@ -64,73 +359,280 @@ func (w *AppServiceStoreWatcher) Stop() {
 	close(w.done)
 }
 
+func (w *AppServiceStoreWatcher) Health() Health {
+	return Health(atomic.LoadInt32(&w.health))
+}
+
 func (w *AppServiceStoreWatcher) Run() {
-	defer func() {
-		close(w.outAddChan)
-		close(w.outRemoveChan)
-	}()
+	defer w.subscriptions.closeAll()
+	switch {
+	case w.queue != nil:
+		go func() {
+			w.queue.run(w.send)
+			w.closeOut()
+		}()
+		defer w.queue.close()
+	case w.buffered != nil:
+		stopped := make(chan struct{})
+		go func() {
+			w.forward(stopped)
+			w.closeOut()
+		}()
+		defer close(stopped)
+	default:
+		defer w.closeOut()
+	}
 
-	events, stopChan, errChan := w.adapter.Watch("/loggregator/services")
+	events, stopChan, errChan := w.adapter.Watch(w.options.KeyPrefix)
+	watchedAt := time.Now()
+	watchFailures, listFailures := 0, 0
+	var retry <-chan time.Time
+
+	resync := func() {
+		if w.reconcile() {
+			listFailures = 0
+			retry = nil
+			w.setHealth(Connected)
+			return
+		}
+		listFailures++
+		retry = time.After(w.backoff(listFailures))
+		w.setHealth(Degraded)
+	}
 
-	w.registerExistingServicesFromStore()
+	resync()
 	for {
-		for {
-			select {
-			case <-w.done:
-				close(stopChan)
+		select {
+		case <-w.done:
+			close(stopChan)
+			return
+		case <-retry:
+			w.setHealth(Resyncing)
+			resync()
+		case err, ok := <-errChan:
+			if !ok {
 				return
-			case err, ok := <-errChan:
-				if !ok {
-					return
-				}
-				log.Printf("AppStoreWatcher: Got error while waiting for ETCD events: %s", err.Error())
-				events, stopChan, errChan = w.adapter.Watch("/loggregator/services")
-			case event, ok := <-events:
-				if !ok {
-					return
-				}
+			}
+			log.Printf("AppStoreWatcher: Got error while waiting for ETCD events: %s", err.Error())
+			w.reportError(err)
+			w.setHealth(Resyncing)
+
+			// A watch that stayed up for a while is not part of a series of
+			// failures.
+			if time.Since(watchedAt) > w.options.MaxBackoff {
+				watchFailures = 0
+			}
+			watchFailures++
+			if !w.wait(w.backoff(watchFailures)) {
+				return
+			}
+
+			events, stopChan, errChan = w.adapter.Watch(w.options.KeyPrefix)
+			watchedAt = time.Now()
+			resync()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			watchFailures = 0
 
-				switch event.Type {
-				case storeadapter.CreateEvent, storeadapter.UpdateEvent:
-					if event.Node.Dir || len(event.Node.Value) == 0 {
-						// we can ignore any directory nodes (app or other namespace additions)
-						continue
-					}
-					w.Add(appServiceFromStoreNode(event.Node))
-				case storeadapter.DeleteEvent:
-					w.deleteEvent(event.PrevNode)
-				case storeadapter.ExpireEvent:
-					w.deleteEvent(event.PrevNode)
+			switch event.Type {
+			case storeadapter.CreateEvent, storeadapter.UpdateEvent:
+				if event.Node.Dir || len(event.Node.Value) == 0 {
+					// we can ignore any directory nodes (app or other namespace additions)
+					continue
+				}
+				if appService, ok := w.decode(event.Node, true); ok {
+					w.setNode(event.Node.Key, appService, event.Node.Index)
+				} else {
+					w.deleteNode(event.Node.Key, event.Node.Index)
 				}
+			case storeadapter.DeleteEvent, storeadapter.ExpireEvent:
+				w.deleteEvent(event)
 			}
 		}
 	}
 }
 
-func (w *AppServiceStoreWatcher) registerExistingServicesFromStore() {
-	services, _ := w.adapter.ListRecursively("/loggregator/services/")
+// reconcile brings the cache in line with the store. Events missed while the
+// watch was down are made up for with synthetic adds and removes. They have no
+// store index: the index of the listed directory is only that of its last
+// change and can be lower than indexes already delivered, and the adapter does
+// not tell the current one. It returns
+// false, leaving the cache as it is, if the store could not be listed.
+func (w *AppServiceStoreWatcher) reconcile() bool {
+	services, err := w.adapter.ListRecursively(w.options.KeyPrefix + "/")
+	if err != nil && err != storeadapter.ErrorKeyNotFound {
+		log.Printf("AppStoreWatcher: Could not list app services, skipping reconciliation: %s", err.Error())
+		w.reportError(err)
+		return false
+	}
+
+	w.storeKeys = newStoreKeys()
+	var listed []appservice.AppService
 	for _, node := range services.ChildNodes {
 		for _, node := range node.ChildNodes {
-			appService := appServiceFromStoreNode(&node)
-			w.Add(appService)
+			if appService, ok := w.decode(&node, true); ok {
+				w.storeKeys.set(node.Key, appService)
+				listed = append(listed, appService)
+			}
+		}
+	}
+
+	for _, appService := range w.cache.GetAll() {
+		if len(w.storeKeys.held(appService)) == 0 {
+			w.remove(appService, 0)
+		}
+	}
+	for _, appService := range listed {
+		w.settle(appService, 0)
+	}
+	w.deliver(Event{Type: Resynced})
+	return true
+}
+
+func (w *AppServiceStoreWatcher) setHealth(health Health) {
+	atomic.StoreInt32(&w.health, int32(health))
+}
+
+func (w *AppServiceStoreWatcher) reportError(err error) {
+	if w.options.OnError != nil {
+		w.options.OnError(err)
+	}
+}
+
+// backoff doubles with every failure up to MaxBackoff and is jittered by up
+// to half its length, so that watchers do not hammer the store in lockstep.
+func (w *AppServiceStoreWatcher) backoff(failures int) time.Duration {
+	duration := w.options.MinBackoff
+	for i := 1; i < failures && duration < w.options.MaxBackoff; i++ {
+		duration *= 2
+	}
+	if duration > w.options.MaxBackoff {
+		duration = w.options.MaxBackoff
+	}
+	return duration/2 + time.Duration(rand.Int63n(int64(duration/2)+1))
+}
+
+// wait returns false if the watcher is stopped first.
+func (w *AppServiceStoreWatcher) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-w.done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func cacheKey(appService appservice.AppService) string {
+	return path.Join(appService.AppId, appService.Id())
+}
+
+// decode turns a node into a normalized AppService. Rejected nodes are logged
+// and reported when report is set.
+func (w *AppServiceStoreWatcher) decode(node *storeadapter.StoreNode, report bool) (appservice.AppService, bool) {
+	appService, err := w.options.DecodeNode(w.options.KeyPrefix, node)
+	if err == nil && w.options.UrlPolicy != nil {
+		appService.Url, err = w.options.UrlPolicy.Normalize(appService.Url)
+	}
+	if err != nil {
+		if report {
+			log.Printf("AppStoreWatcher: Ignoring store node %s: %s", node.Key, err.Error())
+			if w.options.OnRejected != nil {
+				w.options.OnRejected(*node, err)
+			}
 		}
+		return appservice.AppService{}, false
+	}
+	return appService, true
+}
+
+// DecodeUrlNode decodes nodes laid out as <prefix>/<appId>/<id> whose value is
+// the drain URL.
+func DecodeUrlNode(prefix string, node *storeadapter.StoreNode) (appservice.AppService, error) {
+	appId, ok := appIdFromKey(prefix, path.Dir(node.Key))
+	if !ok {
+		return appservice.AppService{}, ErrInvalidNodeKey
+	}
+	return appservice.AppService{AppId: appId, Url: string(node.Value)}, nil
+}
+
+// DecodeAppServiceNode decodes nodes laid out as <prefix>/<appId>/<id> whose
+// value is either the drain URL or the JSON written by AppService.StoreValue.
+func DecodeAppServiceNode(prefix string, node *storeadapter.StoreNode) (appservice.AppService, error) {
+	appId, ok := appIdFromKey(prefix, path.Dir(node.Key))
+	if !ok {
+		return appservice.AppService{}, ErrInvalidNodeKey
 	}
+	return appservice.FromStoreValue(appId, node.Value)
 }
 
-func appServiceFromStoreNode(node *storeadapter.StoreNode) appservice.AppService {
-	key := node.Key
-	appId := path.Base(path.Dir(key))
-	serviceUrl := string(node.Value)
-	appService := appservice.AppService{AppId: appId, Url: serviceUrl}
-	return appService
+// appIdFromKey returns the app id of an app directory key directly below the
+// prefix.
+func appIdFromKey(prefix, key string) (string, bool) {
+	appId := strings.TrimPrefix(key, prefix+"/")
+	if appId == key || appId == "" || strings.Contains(appId, "/") {
+		return "", false
+	}
+	return appId, true
 }
 
-func (w *AppServiceStoreWatcher) deleteEvent(node *storeadapter.StoreNode) {
+func (w *AppServiceStoreWatcher) deleteEvent(event storeadapter.WatchEvent) {
+	node := event.PrevNode
+	index := node.Index
+	if event.Node != nil {
+		index = event.Node.Index
+	}
+
 	if node.Dir {
-		key := node.Key
-		appId := path.Base(key)
-		w.RemoveApp(appId)
-	} else {
-		w.Remove(appServiceFromStoreNode(node))
+		if appId, ok := appIdFromKey(w.options.KeyPrefix, node.Key); ok {
+			w.storeKeys.deleteApp(appId)
+			w.removeApp(appId, index)
+		}
+	} else if !w.deleteNode(node.Key, index) {
+		// app services added with Add are not backed by any known node
+		if appService, ok := w.decode(node, false); ok && len(w.storeKeys.held(appService)) == 0 {
+			w.remove(appService, index)
+		}
+	}
+}
+
+// setNode caches what the node at key holds. If it held another drain before,
+// that one is removed unless other nodes still hold it.
+func (w *AppServiceStoreWatcher) setNode(key string, appService appservice.AppService, index uint64) {
+	if previous, ok := w.storeKeys.set(key, appService); ok && cacheKey(previous) != cacheKey(appService) {
+		w.settle(previous, index)
+	}
+	w.add(appService, index)
+}
+
+// deleteNode returns false if the node at key was not known to hold a drain.
+func (w *AppServiceStoreWatcher) deleteNode(key string, index uint64) bool {
+	previous, ok := w.storeKeys.delete(key)
+	if ok {
+		w.settle(previous, index)
+	}
+	return ok
+}
+
+// settle removes the app service once no node holds it anymore. Otherwise it
+// makes sure the cache holds what one of the remaining nodes holds.
+func (w *AppServiceStoreWatcher) settle(appService appservice.AppService, index uint64) {
+	held := w.storeKeys.held(appService)
+	if len(held) == 0 {
+		w.remove(appService, index)
+		return
+	}
+
+	if cached, ok := w.cached(appService); ok {
+		for _, appService := range held {
+			if cached.Equal(appService) {
+				return
+			}
+		}
 	}
+	w.add(held[0], index)
 }
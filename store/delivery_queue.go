@@ -0,0 +1,135 @@
+package store
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type delivery struct {
+	event    Event
+	queuedAt time.Time
+}
+
+// deliveryQueue is an unbounded queue between the store event loop and the
+// consumer. An Added event that is followed by a Removed event of the same app
+// service before it was delivered cancels out with it.
+type deliveryQueue struct {
+	sync.Mutex
+	deliveries *list.List
+	pendingAdd map[string]*list.Element
+	inFlight   *delivery
+	coalesced  uint64
+	closed     bool
+
+	wakeup  chan struct{}
+	stopped chan struct{}
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{
+		deliveries: list.New(),
+		pendingAdd: make(map[string]*list.Element),
+		wakeup:     make(chan struct{}, 1),
+		stopped:    make(chan struct{}),
+	}
+}
+
+func (q *deliveryQueue) push(event Event) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	key := cacheKey(event.AppService)
+	if element, ok := q.pendingAdd[key]; ok && event.Type == Removed {
+		q.deliveries.Remove(element)
+		delete(q.pendingAdd, key)
+		q.coalesced += 2
+		return
+	}
+
+	element := q.deliveries.PushBack(&delivery{event: event, queuedAt: time.Now()})
+	if event.Type == Added {
+		q.pendingAdd[key] = element
+	}
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the queued events to send until the queue is closed. Whatever is
+// still queued at that point is dropped.
+func (q *deliveryQueue) run(send func(event Event, stopped <-chan struct{}) bool) {
+	for {
+		delivery, ok := q.next()
+		if !ok || !send(delivery.event, q.stopped) {
+			return
+		}
+		q.delivered()
+	}
+}
+
+// next takes the oldest delivery off the queue. Once taken it can no longer
+// be cancelled by a remove.
+func (q *deliveryQueue) next() (*delivery, bool) {
+	for {
+		q.Lock()
+		if q.closed {
+			q.Unlock()
+			return nil, false
+		}
+		if front := q.deliveries.Front(); front != nil {
+			delivery := q.deliveries.Remove(front).(*delivery)
+			if delivery.event.Type == Added {
+				delete(q.pendingAdd, cacheKey(delivery.event.AppService))
+			}
+			q.inFlight = delivery
+			q.Unlock()
+			return delivery, true
+		}
+		q.Unlock()
+
+		select {
+		case <-q.wakeup:
+		case <-q.stopped:
+		}
+	}
+}
+
+func (q *deliveryQueue) delivered() {
+	q.Lock()
+	defer q.Unlock()
+	q.inFlight = nil
+}
+
+func (q *deliveryQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.stopped)
+	}
+}
+
+func (q *deliveryQueue) stats() DeliveryStats {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := DeliveryStats{Depth: q.deliveries.Len(), Coalesced: q.coalesced}
+	oldest := q.inFlight
+	if oldest != nil {
+		stats.Depth++
+	} else if front := q.deliveries.Front(); front != nil {
+		oldest = front.Value.(*delivery)
+	}
+	if oldest != nil {
+		stats.Lag = time.Since(oldest.queuedAt)
+	}
+	return stats
+}
@@ -0,0 +1,46 @@
+package store
+
+import "github.com/cloudfoundry/loggregatorlib/appservice"
+
+type EventType int
+
+const (
+	// Added carries a new AppService.
+	Added EventType = iota + 1
+	// Removed carries an AppService that is gone from the store.
+	Removed
+	// AppRemoved carries the AppId and the AppServices of an app whose
+	// directory was deleted or expired.
+	AppRemoved
+	// Resynced follows the Added and Removed events that brought the cache in
+	// line with a fresh listing of the store.
+	Resynced
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case AppRemoved:
+		return "app removed"
+	case Resynced:
+		return "resynced"
+	}
+	return "unknown"
+}
+
+// Event is a change of the watched app services. Sequence numbers increase by
+// one with every event the watcher produces; with DeliverCoalesced the events
+// that cancelled each other out leave gaps. Index is the store index of the
+// change. It is 0 for the events of a resync and for changes made through the
+// watcher's Add, Remove and RemoveApp methods.
+type Event struct {
+	Type        EventType
+	AppId       string
+	AppService  appservice.AppService
+	AppServices []appservice.AppService
+	Sequence    uint64
+	Index       uint64
+}
@@ -0,0 +1,472 @@
+package memorystoreadapter
+
+import (
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/storeadapter"
+)
+
+const defaultExpiryInterval = 100 * time.Millisecond
+
+// MemoryStoreAdapter is a storeadapter.StoreAdapter that keeps its nodes in
+// memory, for tests and local runs without etcd. It follows etcd's semantics
+// closely enough to drive the store watcher: every change increments the
+// store index and is sent to the matching watches, directories are created
+// implicitly and nodes with a TTL expire.
+type MemoryStoreAdapter struct {
+	clock              Clock
+	expireInBackground bool
+
+	sync.Mutex
+	root       *entry
+	index      uint64
+	watches    map[*watch]struct{}
+	listErr    error
+	stopExpiry chan struct{}
+}
+
+type entry struct {
+	key       string
+	value     []byte
+	dir       bool
+	children  map[string]*entry
+	expiresAt time.Time
+	index     uint64
+}
+
+// New returns an adapter on the real clock. Between Connect and Disconnect
+// expired nodes are removed in the background.
+func New() *MemoryStoreAdapter {
+	adapter := NewWithClock(realClock{})
+	adapter.expireInBackground = true
+	return adapter
+}
+
+// NewWithClock returns an adapter whose TTLs run on clock. Nodes that expired
+// are removed, and their ExpireEvents sent, by the next call to the adapter or
+// to ExpireNodes.
+func NewWithClock(clock Clock) *MemoryStoreAdapter {
+	return &MemoryStoreAdapter{
+		clock:   clock,
+		root:    &entry{key: "/", dir: true, children: make(map[string]*entry)},
+		watches: make(map[*watch]struct{}),
+	}
+}
+
+func (a *MemoryStoreAdapter) Connect() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.expireInBackground && a.stopExpiry == nil {
+		a.stopExpiry = make(chan struct{})
+		go a.expireEvery(defaultExpiryInterval, a.stopExpiry)
+	}
+	return nil
+}
+
+func (a *MemoryStoreAdapter) Disconnect() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.stopExpiry != nil {
+		close(a.stopExpiry)
+		a.stopExpiry = nil
+	}
+	return nil
+}
+
+func (a *MemoryStoreAdapter) Create(node storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	if a.lookup(node.Key) != nil {
+		return storeadapter.ErrorKeyExists
+	}
+	return a.set(node)
+}
+
+func (a *MemoryStoreAdapter) Update(node storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	if a.lookup(node.Key) == nil {
+		return storeadapter.ErrorKeyNotFound
+	}
+	return a.set(node)
+}
+
+func (a *MemoryStoreAdapter) SetMulti(nodes []storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	for _, node := range nodes {
+		if err := a.set(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *MemoryStoreAdapter) CompareAndSwap(oldNode storeadapter.StoreNode, newNode storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	e, err := a.leaf(oldNode.Key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(e.value, oldNode.Value) {
+		return storeadapter.ErrorKeyComparisonFailed
+	}
+	return a.set(newNode)
+}
+
+func (a *MemoryStoreAdapter) CompareAndSwapByIndex(prevIndex uint64, newNode storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	e, err := a.leaf(newNode.Key)
+	if err != nil {
+		return err
+	}
+	if e.index != prevIndex {
+		return storeadapter.ErrorKeyComparisonFailed
+	}
+	return a.set(newNode)
+}
+
+func (a *MemoryStoreAdapter) Get(key string) (storeadapter.StoreNode, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	e, err := a.leaf(key)
+	if err != nil {
+		return storeadapter.StoreNode{}, err
+	}
+	return a.snapshot(e, false), nil
+}
+
+func (a *MemoryStoreAdapter) ListRecursively(key string) (storeadapter.StoreNode, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	if a.listErr != nil {
+		return storeadapter.StoreNode{}, a.listErr
+	}
+	e := a.lookup(key)
+	if e == nil {
+		return storeadapter.StoreNode{}, storeadapter.ErrorKeyNotFound
+	}
+	if !e.dir {
+		return storeadapter.StoreNode{}, storeadapter.ErrorNodeIsNotDirectory
+	}
+	return a.snapshot(e, true), nil
+}
+
+// Delete removes nodes and directories with everything below them.
+func (a *MemoryStoreAdapter) Delete(keys ...string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	for _, key := range keys {
+		e := a.lookup(key)
+		if e == nil {
+			return storeadapter.ErrorKeyNotFound
+		}
+		a.remove(e, storeadapter.DeleteEvent)
+	}
+	return nil
+}
+
+// DeleteLeaves removes nodes and empty directories.
+func (a *MemoryStoreAdapter) DeleteLeaves(keys ...string) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	for _, key := range keys {
+		e := a.lookup(key)
+		if e == nil {
+			return storeadapter.ErrorKeyNotFound
+		}
+		if e.dir && len(e.children) > 0 {
+			return storeadapter.ErrorNodeIsDirectory
+		}
+		a.remove(e, storeadapter.DeleteEvent)
+	}
+	return nil
+}
+
+func (a *MemoryStoreAdapter) CompareAndDelete(nodes ...storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	for _, node := range nodes {
+		e, err := a.leaf(node.Key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(e.value, node.Value) {
+			return storeadapter.ErrorKeyComparisonFailed
+		}
+		a.remove(e, storeadapter.DeleteEvent)
+	}
+	return nil
+}
+
+func (a *MemoryStoreAdapter) CompareAndDeleteByIndex(nodes ...storeadapter.StoreNode) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	for _, node := range nodes {
+		e, err := a.leaf(node.Key)
+		if err != nil {
+			return err
+		}
+		if e.index != node.Index {
+			return storeadapter.ErrorKeyComparisonFailed
+		}
+		a.remove(e, storeadapter.DeleteEvent)
+	}
+	return nil
+}
+
+func (a *MemoryStoreAdapter) UpdateDirTTL(key string, ttl uint64) error {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+
+	e := a.lookup(key)
+	if e == nil {
+		return storeadapter.ErrorKeyNotFound
+	}
+	if !e.dir {
+		return storeadapter.ErrorNodeIsNotDirectory
+	}
+
+	prev := a.snapshot(e, false)
+	a.index++
+	e.index = a.index
+	e.expiresAt = a.expiresAt(ttl)
+	node := a.snapshot(e, false)
+	a.dispatch(storeadapter.WatchEvent{Type: storeadapter.UpdateEvent, Node: &node, PrevNode: &prev})
+	return nil
+}
+
+// MaintainNode sets the node without a TTL and deletes it once released. The
+// node is never lost.
+func (a *MemoryStoreAdapter) MaintainNode(node storeadapter.StoreNode) (<-chan bool, chan chan bool, error) {
+	node.TTL = 0
+	if err := a.SetMulti([]storeadapter.StoreNode{node}); err != nil {
+		return nil, nil, err
+	}
+
+	release := make(chan chan bool)
+	go func() {
+		released := <-release
+		a.Delete(node.Key)
+		close(released)
+	}()
+	return make(chan bool), release, nil
+}
+
+// ExpireNodes removes the nodes whose TTL ran out and sends an ExpireEvent
+// for each of them.
+func (a *MemoryStoreAdapter) ExpireNodes() {
+	a.Lock()
+	defer a.Unlock()
+	a.expire()
+}
+
+// FailListing makes ListRecursively return err until it is called with nil.
+func (a *MemoryStoreAdapter) FailListing(err error) {
+	a.Lock()
+	defer a.Unlock()
+	a.listErr = err
+}
+
+func (a *MemoryStoreAdapter) expireEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			a.ExpireNodes()
+		}
+	}
+}
+
+func (a *MemoryStoreAdapter) expire() {
+	a.expireBelow(a.root, a.clock.Now())
+}
+
+func (a *MemoryStoreAdapter) expireBelow(dir *entry, now time.Time) {
+	for _, name := range sortedNames(dir) {
+		child := dir.children[name]
+		if !child.expiresAt.IsZero() && !now.Before(child.expiresAt) {
+			a.remove(child, storeadapter.ExpireEvent)
+		} else if child.dir {
+			a.expireBelow(child, now)
+		}
+	}
+}
+
+func (a *MemoryStoreAdapter) set(node storeadapter.StoreNode) error {
+	key := cleanKey(node.Key)
+	if key == "/" {
+		return storeadapter.ErrorNodeIsDirectory
+	}
+	parent, err := a.makeParents(key)
+	if err != nil {
+		return err
+	}
+
+	name := path.Base(key)
+	prev := parent.children[name]
+	if prev != nil && prev.dir != node.Dir {
+		if prev.dir {
+			return storeadapter.ErrorNodeIsDirectory
+		}
+		return storeadapter.ErrorNodeIsNotDirectory
+	}
+
+	a.index++
+	e := &entry{key: key, dir: node.Dir, index: a.index, expiresAt: a.expiresAt(node.TTL)}
+	if node.Dir {
+		e.children = make(map[string]*entry)
+		if prev != nil {
+			e.children = prev.children
+		}
+	} else {
+		e.value = append([]byte(nil), node.Value...)
+	}
+	parent.children[name] = e
+
+	event := storeadapter.WatchEvent{Type: storeadapter.CreateEvent}
+	if prev != nil {
+		prevNode := a.snapshot(prev, false)
+		event.Type = storeadapter.UpdateEvent
+		event.PrevNode = &prevNode
+	}
+	newNode := a.snapshot(e, false)
+	event.Node = &newNode
+	a.dispatch(event)
+	return nil
+}
+
+func (a *MemoryStoreAdapter) remove(e *entry, eventType storeadapter.EventType) {
+	if e == a.root {
+		for _, name := range sortedNames(e) {
+			a.remove(e.children[name], eventType)
+		}
+		return
+	}
+
+	parent := a.lookup(path.Dir(e.key))
+	delete(parent.children, path.Base(e.key))
+
+	a.index++
+	prevNode := a.snapshot(e, false)
+	a.dispatch(storeadapter.WatchEvent{
+		Type:     eventType,
+		Node:     &storeadapter.StoreNode{Key: e.key, Dir: e.dir, Index: a.index},
+		PrevNode: &prevNode,
+	})
+}
+
+func (a *MemoryStoreAdapter) makeParents(key string) (*entry, error) {
+	dir := a.root
+	for _, name := range strings.Split(strings.Trim(path.Dir(key), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := dir.children[name]
+		if !ok {
+			child = &entry{key: path.Join(dir.key, name), dir: true, children: make(map[string]*entry), index: a.index + 1}
+			dir.children[name] = child
+		}
+		if !child.dir {
+			return nil, storeadapter.ErrorNodeIsNotDirectory
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+func (a *MemoryStoreAdapter) lookup(key string) *entry {
+	e := a.root
+	for _, name := range strings.Split(strings.Trim(cleanKey(key), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if e = e.children[name]; e == nil {
+			return nil
+		}
+	}
+	return e
+}
+
+func (a *MemoryStoreAdapter) leaf(key string) (*entry, error) {
+	e := a.lookup(key)
+	if e == nil {
+		return nil, storeadapter.ErrorKeyNotFound
+	}
+	if e.dir {
+		return nil, storeadapter.ErrorNodeIsDirectory
+	}
+	return e, nil
+}
+
+func (a *MemoryStoreAdapter) expiresAt(ttl uint64) time.Time {
+	if ttl == 0 {
+		return time.Time{}
+	}
+	return a.clock.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+func (a *MemoryStoreAdapter) snapshot(e *entry, recursive bool) storeadapter.StoreNode {
+	node := storeadapter.StoreNode{Key: e.key, Dir: e.dir, Index: e.index}
+	if !e.dir {
+		node.Value = append([]byte(nil), e.value...)
+	}
+	if !e.expiresAt.IsZero() {
+		node.TTL = uint64((e.expiresAt.Sub(a.clock.Now()) + time.Second - 1) / time.Second)
+	}
+	if recursive {
+		for _, name := range sortedNames(e) {
+			node.ChildNodes = append(node.ChildNodes, a.snapshot(e.children[name], true))
+		}
+	}
+	return node
+}
+
+func sortedNames(dir *entry) []string {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func cleanKey(key string) string {
+	return path.Clean("/" + key)
+}
@@ -0,0 +1,196 @@
+package memorystoreadapter_test
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+	"github.com/cloudfoundry/loggregatorlib/store"
+	"github.com/cloudfoundry/loggregatorlib/store/cache"
+	. "github.com/cloudfoundry/loggregatorlib/store/memorystoreadapter"
+	"github.com/cloudfoundry/storeadapter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ storeadapter.StoreAdapter = (*MemoryStoreAdapter)(nil)
+
+var _ = Describe("MemoryStoreAdapter", func() {
+	var clock *FakeClock
+	var adapter *MemoryStoreAdapter
+
+	node := func(key, value string) storeadapter.StoreNode {
+		return storeadapter.StoreNode{Key: key, Value: []byte(value)}
+	}
+
+	BeforeEach(func() {
+		clock = NewFakeClock(time.Unix(1000, 0))
+		adapter = NewWithClock(clock)
+		Expect(adapter.Connect()).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(adapter.Disconnect()).To(Succeed())
+	})
+
+	It("creates, updates, gets and deletes nodes", func() {
+		Expect(adapter.Create(node("/a/b", "1"))).To(Succeed())
+		Expect(adapter.Create(node("/a/b", "2"))).To(Equal(storeadapter.ErrorKeyExists))
+		Expect(adapter.Update(node("/a/c", "2"))).To(Equal(storeadapter.ErrorKeyNotFound))
+		Expect(adapter.Update(node("/a/b", "2"))).To(Succeed())
+
+		Expect(adapter.Get("/a/b")).To(Equal(storeadapter.StoreNode{Key: "/a/b", Value: []byte("2"), Index: 2}))
+		_, err := adapter.Get("/a")
+		Expect(err).To(Equal(storeadapter.ErrorNodeIsDirectory))
+
+		Expect(adapter.Delete("/a/b")).To(Succeed())
+		_, err = adapter.Get("/a/b")
+		Expect(err).To(Equal(storeadapter.ErrorKeyNotFound))
+		Expect(adapter.Delete("/a/b")).To(Equal(storeadapter.ErrorKeyNotFound))
+	})
+
+	It("lists directories recursively", func() {
+		Expect(adapter.SetMulti([]storeadapter.StoreNode{node("/a/x/2", "2"), node("/a/x/1", "1"), node("/a/y", "3")})).To(Succeed())
+
+		listing, err := adapter.ListRecursively("/a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(listing.Dir).To(BeTrue())
+		Expect(listing.ChildNodes).To(HaveLen(2))
+		Expect(listing.ChildNodes[0].Key).To(Equal("/a/x"))
+		Expect(listing.ChildNodes[0].ChildNodes).To(Equal([]storeadapter.StoreNode{
+			{Key: "/a/x/1", Value: []byte("1"), Index: 2},
+			{Key: "/a/x/2", Value: []byte("2"), Index: 1},
+		}))
+		Expect(listing.ChildNodes[1]).To(Equal(storeadapter.StoreNode{Key: "/a/y", Value: []byte("3"), Index: 3}))
+
+		_, err = adapter.ListRecursively("/a/y")
+		Expect(err).To(Equal(storeadapter.ErrorNodeIsNotDirectory))
+		_, err = adapter.ListRecursively("/b")
+		Expect(err).To(Equal(storeadapter.ErrorKeyNotFound))
+
+		Expect(adapter.DeleteLeaves("/a/x")).To(Equal(storeadapter.ErrorNodeIsDirectory))
+		Expect(adapter.Delete("/a/x")).To(Succeed())
+		listing, _ = adapter.ListRecursively("/a")
+		Expect(listing.ChildNodes).To(HaveLen(1))
+	})
+
+	It("compares before swapping and deleting", func() {
+		Expect(adapter.Create(node("/a", "1"))).To(Succeed())
+
+		Expect(adapter.CompareAndSwap(node("/a", "2"), node("/a", "3"))).To(Equal(storeadapter.ErrorKeyComparisonFailed))
+		Expect(adapter.CompareAndSwap(node("/a", "1"), node("/a", "3"))).To(Succeed())
+		Expect(adapter.CompareAndSwapByIndex(1, node("/a", "4"))).To(Equal(storeadapter.ErrorKeyComparisonFailed))
+		Expect(adapter.CompareAndSwapByIndex(2, node("/a", "4"))).To(Succeed())
+
+		Expect(adapter.CompareAndDelete(node("/a", "3"))).To(Equal(storeadapter.ErrorKeyComparisonFailed))
+		Expect(adapter.CompareAndDeleteByIndex(storeadapter.StoreNode{Key: "/a", Index: 3})).To(Succeed())
+		_, err := adapter.Get("/a")
+		Expect(err).To(Equal(storeadapter.ErrorKeyNotFound))
+	})
+
+	It("expires nodes and directories on the clock", func() {
+		Expect(adapter.Create(storeadapter.StoreNode{Key: "/a/b", Value: []byte("1"), TTL: 10})).To(Succeed())
+		Expect(adapter.Create(node("/c/d", "2"))).To(Succeed())
+		Expect(adapter.UpdateDirTTL("/c", 20)).To(Succeed())
+
+		clock.Advance(5 * time.Second)
+		Expect(adapter.Get("/a/b")).To(Equal(storeadapter.StoreNode{Key: "/a/b", Value: []byte("1"), TTL: 5, Index: 1}))
+
+		clock.Advance(5 * time.Second)
+		_, err := adapter.Get("/a/b")
+		Expect(err).To(Equal(storeadapter.ErrorKeyNotFound))
+		_, err = adapter.Get("/c/d")
+		Expect(err).NotTo(HaveOccurred())
+
+		clock.Advance(10 * time.Second)
+		_, err = adapter.ListRecursively("/c")
+		Expect(err).To(Equal(storeadapter.ErrorKeyNotFound))
+	})
+
+	Describe("Watch", func() {
+		It("sends the changes below the key", func() {
+			events, stop, _ := adapter.Watch("/a")
+
+			Expect(adapter.Create(node("/a/b", "1"))).To(Succeed())
+			Expect(adapter.Create(node("/ab", "x"))).To(Succeed())
+			Expect(adapter.Update(node("/a/b", "2"))).To(Succeed())
+			Expect(adapter.Create(storeadapter.StoreNode{Key: "/a/c", Value: []byte("3"), TTL: 1})).To(Succeed())
+			Expect(adapter.Delete("/a/b")).To(Succeed())
+			clock.Advance(time.Second)
+			adapter.ExpireNodes()
+
+			var event storeadapter.WatchEvent
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(storeadapter.CreateEvent))
+			Expect(*event.Node).To(Equal(storeadapter.StoreNode{Key: "/a/b", Value: []byte("1"), Index: 1}))
+			Expect(event.PrevNode).To(BeNil())
+
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(storeadapter.UpdateEvent))
+			Expect(event.Node.Value).To(Equal([]byte("2")))
+			Expect(event.PrevNode.Value).To(Equal([]byte("1")))
+
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(storeadapter.CreateEvent))
+			Expect(event.Node.TTL).To(Equal(uint64(1)))
+
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(storeadapter.DeleteEvent))
+			Expect(event.PrevNode.Key).To(Equal("/a/b"))
+			Expect(event.Node.Index).To(Equal(uint64(5)))
+
+			Eventually(events).Should(Receive(&event))
+			Expect(event.Type).To(Equal(storeadapter.ExpireEvent))
+			Expect(event.PrevNode.Key).To(Equal("/a/c"))
+
+			close(stop)
+			Eventually(events).Should(BeClosed())
+			Expect(adapter.WatchCount()).To(BeZero())
+		})
+
+		It("fails watches on demand", func() {
+			events, _, errs := adapter.Watch("/")
+			_, stop, _ := adapter.Watch("/a")
+			stop <- true
+			Eventually(adapter.WatchCount).Should(Equal(1))
+
+			watchErr := errors.New("connection lost")
+			Expect(adapter.FailWatches(watchErr)).To(Equal(1))
+			Expect(errs).To(Receive(Equal(watchErr)))
+
+			Expect(adapter.Create(node("/a/b", "1"))).To(Succeed())
+			Consistently(events).ShouldNot(Receive())
+			Expect(adapter.WatchCount()).To(BeZero())
+		})
+	})
+
+	It("drives the app service store watcher", func() {
+		registrar := store.NewAppServiceRegistrarWithOptions(adapter, store.AppServiceRegistrarOptions{TTL: 60})
+		drain := appservice.AppService{AppId: "app-1", Url: "syslog://drain.example.com:514"}
+		Expect(registrar.Create(drain)).To(Succeed())
+
+		watcher, events := store.NewAppServiceStoreEventWatcher(adapter, cache.NewAppServiceCache(), store.AppServiceStoreWatcherOptions{MinBackoff: time.Millisecond})
+		go watcher.Run()
+		defer watcher.Stop()
+
+		var event store.Event
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(store.Added))
+		Expect(event.AppService).To(Equal(drain))
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(store.Resynced))
+
+		adapter.FailListing(errors.New("timeout"))
+		adapter.FailWatches(errors.New("connection lost"))
+		Eventually(watcher.Health).Should(Equal(store.Degraded))
+
+		clock.Advance(time.Minute)
+		adapter.FailListing(nil)
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(store.Removed))
+		Expect(event.AppService).To(Equal(drain))
+		Eventually(events).Should(Receive(&event))
+		Expect(event.Type).To(Equal(store.Resynced))
+		Eventually(watcher.Health).Should(Equal(store.Connected))
+	})
+})
@@ -0,0 +1,13 @@
+package memorystoreadapter_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMemoryStoreAdapter(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "MemoryStoreAdapter Suite")
+}
@@ -0,0 +1,130 @@
+package memorystoreadapter
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/cloudfoundry/storeadapter"
+)
+
+// watch queues the events for its key so that a slow consumer never holds up
+// the adapter.
+type watch struct {
+	key    string
+	events chan storeadapter.WatchEvent
+	errs   chan error
+	stop   chan bool
+
+	sync.Mutex
+	queue  []storeadapter.WatchEvent
+	wakeup chan struct{}
+	failed chan struct{}
+}
+
+// Watch sends the events for key and everything below it until true is sent
+// on or close is called for the stop channel, which closes the events
+// channel, or until FailWatches is called.
+func (a *MemoryStoreAdapter) Watch(key string) (<-chan storeadapter.WatchEvent, chan<- bool, <-chan error) {
+	w := &watch{
+		key:    cleanKey(key),
+		events: make(chan storeadapter.WatchEvent),
+		errs:   make(chan error, 1),
+		stop:   make(chan bool, 1),
+		wakeup: make(chan struct{}, 1),
+		failed: make(chan struct{}),
+	}
+
+	a.Lock()
+	a.watches[w] = struct{}{}
+	a.Unlock()
+
+	go a.runWatch(w)
+	return w.events, w.stop, w.errs
+}
+
+// FailWatches sends err on the error channel of every active watch and ends
+// them, like a lost connection to etcd does. Their events channels stay open.
+// It returns the number of watches that failed.
+func (a *MemoryStoreAdapter) FailWatches(err error) int {
+	a.Lock()
+	defer a.Unlock()
+
+	failed := len(a.watches)
+	for w := range a.watches {
+		w.errs <- err
+		close(w.failed)
+		delete(a.watches, w)
+	}
+	return failed
+}
+
+// WatchCount returns the number of active watches.
+func (a *MemoryStoreAdapter) WatchCount() int {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.watches)
+}
+
+func (a *MemoryStoreAdapter) dispatch(event storeadapter.WatchEvent) {
+	for w := range a.watches {
+		if w.matches(event.Node.Key) {
+			w.push(event)
+		}
+	}
+}
+
+func (a *MemoryStoreAdapter) runWatch(w *watch) {
+	for {
+		event, ok := w.next()
+		if ok {
+			select {
+			case w.events <- event:
+				continue
+			case <-w.stop:
+			case <-w.failed:
+				return
+			}
+		} else {
+			select {
+			case <-w.wakeup:
+				continue
+			case <-w.stop:
+			case <-w.failed:
+				return
+			}
+		}
+
+		a.Lock()
+		delete(a.watches, w)
+		a.Unlock()
+		close(w.events)
+		return
+	}
+}
+
+func (w *watch) matches(key string) bool {
+	return w.key == "/" || key == w.key || strings.HasPrefix(key, w.key+"/")
+}
+
+func (w *watch) push(event storeadapter.WatchEvent) {
+	w.Lock()
+	w.queue = append(w.queue, event)
+	w.Unlock()
+
+	select {
+	case w.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watch) next() (storeadapter.WatchEvent, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	if len(w.queue) == 0 {
+		return storeadapter.WatchEvent{}, false
+	}
+	event := w.queue[0]
+	w.queue = w.queue[1:]
+	return event, true
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"sort"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+)
+
+// storeKeys remembers which store nodes every cached app service was decoded
+// from. Several nodes can hold the same drain, like a node keyed by the hash of
+// the url as it was once written and one keyed by the Id of the normalized url,
+// and the drain is only gone once the last of them is. It is only used by the
+// store event loop and needs no locking.
+type storeKeys struct {
+	byKey   map[string]appservice.AppService
+	byCache map[string]map[string]bool
+}
+
+func newStoreKeys() *storeKeys {
+	return &storeKeys{
+		byKey:   make(map[string]appservice.AppService),
+		byCache: make(map[string]map[string]bool),
+	}
+}
+
+// set records that the node at key holds appService and returns what it held
+// before.
+func (s *storeKeys) set(key string, appService appservice.AppService) (appservice.AppService, bool) {
+	previous, ok := s.delete(key)
+
+	s.byKey[key] = appService
+	keys, found := s.byCache[cacheKey(appService)]
+	if !found {
+		keys = make(map[string]bool)
+		s.byCache[cacheKey(appService)] = keys
+	}
+	keys[key] = true
+	return previous, ok
+}
+
+// delete forgets the node at key and returns what it held.
+func (s *storeKeys) delete(key string) (appservice.AppService, bool) {
+	appService, ok := s.byKey[key]
+	if !ok {
+		return appservice.AppService{}, false
+	}
+
+	delete(s.byKey, key)
+	keys := s.byCache[cacheKey(appService)]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(s.byCache, cacheKey(appService))
+	}
+	return appService, true
+}
+
+func (s *storeKeys) deleteApp(appId string) {
+	for key, appService := range s.byKey {
+		if appService.AppId == appId {
+			s.delete(key)
+		}
+	}
+}
+
+// held returns what the nodes holding the app service hold, ordered by their
+// keys.
+func (s *storeKeys) held(appService appservice.AppService) []appservice.AppService {
+	keys := make([]string, 0, len(s.byCache[cacheKey(appService)]))
+	for key := range s.byCache[cacheKey(appService)] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	appServices := make([]appservice.AppService, len(keys))
+	for i, key := range keys {
+		appServices[i] = s.byKey[key]
+	}
+	return appServices
+}
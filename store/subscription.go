@@ -0,0 +1,129 @@
+package store
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudfoundry/loggregatorlib/appservice"
+)
+
+// AppServiceHandler is notified of the changes seen by a watcher. OnResync is
+// called after the adds and removes that brought the watcher in line with a
+// fresh listing of the store.
+type AppServiceHandler interface {
+	OnAdd(appService appservice.AppService)
+	OnRemove(appService appservice.AppService)
+	OnResync()
+}
+
+// Subscription calls its handler from a goroutine of its own, so a slow or
+// failing handler holds up neither the watcher nor the other subscribers. The
+// changes waiting for the handler are queued like with DeliverCoalesced.
+type Subscription struct {
+	watcher *AppServiceStoreWatcher
+	handler AppServiceHandler
+	queue   *deliveryQueue
+	panics  uint64
+}
+
+type subscriptions struct {
+	sync.Mutex
+	active map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscribe calls handler with every change from now on; subscribe before
+// calling Run to see every app service. The subscription ends when it is
+// cancelled or the watcher stops. Watchers that also deliver on channels wait
+// for them to be read; use NewAppServiceStoreSubscriptionWatcher if nothing
+// reads them.
+func (w *AppServiceStoreWatcher) Subscribe(handler AppServiceHandler) *Subscription {
+	subscription := &Subscription{watcher: w, handler: handler, queue: newDeliveryQueue()}
+	go subscription.queue.run(subscription.handle)
+	w.subscriptions.add(subscription)
+	return subscription
+}
+
+func (w *AppServiceStoreWatcher) publish(event Event) {
+	w.subscriptions.Lock()
+	defer w.subscriptions.Unlock()
+
+	for subscription := range w.subscriptions.active {
+		if event.Type == AppRemoved {
+			for _, appService := range event.AppServices {
+				subscription.queue.push(Event{Type: Removed, AppId: event.AppId, AppService: appService, Sequence: event.Sequence, Index: event.Index})
+			}
+			continue
+		}
+		subscription.queue.push(event)
+	}
+}
+
+// Unsubscribe stops the delivery to the handler; changes it has not been
+// called with yet are dropped. It is safe to call more than once.
+func (s *Subscription) Unsubscribe() {
+	s.watcher.subscriptions.remove(s)
+	s.queue.close()
+}
+
+// Panics returns the number of handler calls that panicked.
+func (s *Subscription) Panics() uint64 {
+	return atomic.LoadUint64(&s.panics)
+}
+
+func (s *Subscription) DeliveryStats() DeliveryStats {
+	return s.queue.stats()
+}
+
+// handle keeps the subscription going when the handler panics.
+func (s *Subscription) handle(event Event, _ <-chan struct{}) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			atomic.AddUint64(&s.panics, 1)
+			log.Printf("AppStoreWatcher: Subscriber panicked on %s event: %v", event.Type, err)
+			ok = true
+		}
+	}()
+
+	switch event.Type {
+	case Added:
+		s.handler.OnAdd(event.AppService)
+	case Removed:
+		s.handler.OnRemove(event.AppService)
+	case Resynced:
+		s.handler.OnResync()
+	}
+	return true
+}
+
+func (s *subscriptions) add(subscription *Subscription) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		subscription.queue.close()
+		return
+	}
+	if s.active == nil {
+		s.active = make(map[*Subscription]struct{})
+	}
+	s.active[subscription] = struct{}{}
+}
+
+func (s *subscriptions) remove(subscription *Subscription) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.active, subscription)
+}
+
+func (s *subscriptions) closeAll() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	for subscription := range s.active {
+		subscription.queue.close()
+	}
+	s.active = nil
+}